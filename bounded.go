@@ -26,6 +26,9 @@ type UsageInfo struct {
 	Used     int64 // The number of bytes used by the storage
 	Capacity int64 // The maximum number of bytes usable by the storage
 	Locked   int64 // The number of bytes currently locked by the storage
+
+	Entries   int   // The number of entries (files and chunks) stored
+	Evictions int64 // The number of entries removed to free space since the storage was created
 }
 
 func (ui UsageInfo) String() string {
@@ -19,9 +19,11 @@
 package cafs
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"io"
+	"time"
 )
 
 var ErrNotFound = errors.New("Not found")
@@ -47,6 +49,38 @@ type FileStorage interface {
 	DumpStatistics(log Printer)
 }
 
+// Interface WaitableStorage describes file storage that notifies waiting parties as soon as a file
+// becomes available.
+type WaitableStorage interface {
+	FileStorage
+
+	// Blocks until the file identified by `key` exists in the storage, or until `ctx` is done.
+	// Returns the file, locked once like with Get, or ctx.Err().
+	WaitFor(ctx context.Context, key *SKey) (File, error)
+}
+
+// Function WaitFor blocks until the file identified by `key` exists in `storage`, or until `ctx`
+// is done. If the storage doesn't implement WaitableStorage, falls back to polling.
+func WaitFor(ctx context.Context, storage FileStorage, key *SKey) (File, error) {
+	if s, ok := storage.(WaitableStorage); ok {
+		return s.WaitFor(ctx, key)
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if f, err := storage.Get(key); err != ErrNotFound {
+			return f, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+			// next try
+		}
+	}
+}
+
 type File interface {
 	// Signals that this file handle is no longer in use.
 	// If no handles exist on a file anymore, the storage space
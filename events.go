@@ -0,0 +1,164 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"fmt"
+)
+
+// Type StorageEventType specifies what happened to an entry of a storage.
+type StorageEventType int
+
+const (
+	// A new entry (file or chunk) has been stored. New entries are locked.
+	EventStored StorageEventType = iota
+	// An entry has been stored that already existed, and the existing entry is used instead.
+	EventRecycled
+	// An entry that was not locked by anybody has been locked and is therefore safe from eviction.
+	EventLocked
+	// The last lock on an entry has been released. The entry may now be evicted.
+	EventReleased
+	// An entry has been removed to free space.
+	EventEvicted
+	// The subscriber didn't consume events fast enough, and some have been dropped.
+	EventOverflow
+)
+
+func (t StorageEventType) String() string {
+	switch t {
+	case EventStored:
+		return "stored"
+	case EventRecycled:
+		return "recycled"
+	case EventLocked:
+		return "locked"
+	case EventReleased:
+		return "released"
+	case EventEvicted:
+		return "evicted"
+	case EventOverflow:
+		return "overflow"
+	}
+	return fmt.Sprintf("StorageEventType(%d)", int(t))
+}
+
+// Struct StorageEvent describes a change of a storage's entries.
+type StorageEvent struct {
+	Type    StorageEventType
+	Key     SKey   // The entry concerned. Zero for EventOverflow.
+	Size    int64  // The number of bytes of storage accounted to the entry
+	Info    string // The info string given when the entry was created
+	Dropped int    // For EventOverflow: the number of events dropped
+}
+
+func (e StorageEvent) String() string {
+	if e.Type == EventOverflow {
+		return fmt.Sprintf("%v: %d events dropped", e.Type, e.Dropped)
+	}
+	return fmt.Sprintf("%v: %v (%d bytes) [%v]", e.Type, e.Key, e.Size, e.Info)
+}
+
+// Type StorageEventFilter decides whether a subscriber is interested in an event. It is called while
+// the storage is locked and must therefore be fast and must not access the storage.
+type StorageEventFilter func(e *StorageEvent) bool
+
+// Function EventTypes returns a filter accepting only events of the given types.
+func EventTypes(types ...StorageEventType) StorageEventFilter {
+	return func(e *StorageEvent) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// The number of events buffered per subscriber. When the buffer is full, further events are dropped.
+// The number of events dropped is reported by an EventOverflow, which is delivered together with the
+// next event accepted by the subscriber that fits into the buffer, not before.
+var EventBufferSize = 256
+
+// Interface ObservableStorage describes file storage that publishes changes of its entries.
+type ObservableStorage interface {
+	FileStorage
+
+	// Returns a channel receiving all events accepted by `filter`, or all events if `filter` is nil.
+	// Events are never blocked on; see EventBufferSize.
+	Subscribe(filter StorageEventFilter) <-chan StorageEvent
+
+	// Ends a subscription and closes its channel.
+	Unsubscribe(ch <-chan StorageEvent)
+}
+
+// Struct EventFeed implements the subscriber management of an ObservableStorage. It is not safe
+// for concurrent use; storages call it while holding their own lock.
+type EventFeed struct {
+	subscribers []*subscriber
+}
+
+type subscriber struct {
+	ch      chan StorageEvent
+	filter  StorageEventFilter
+	dropped int
+}
+
+// Adds a subscriber.
+func (f *EventFeed) Subscribe(filter StorageEventFilter) <-chan StorageEvent {
+	s := &subscriber{ch: make(chan StorageEvent, EventBufferSize), filter: filter}
+	f.subscribers = append(f.subscribers, s)
+	return s.ch
+}
+
+// Removes a subscriber and closes its channel.
+func (f *EventFeed) Unsubscribe(ch <-chan StorageEvent) {
+	for i, s := range f.subscribers {
+		if s.ch == ch {
+			close(s.ch)
+			f.subscribers = append(f.subscribers[:i], f.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns true if there are any subscribers. Allows skipping the construction of events.
+func (f *EventFeed) Active() bool {
+	return len(f.subscribers) > 0
+}
+
+// Delivers an event to all interested subscribers without blocking.
+func (f *EventFeed) Publish(e StorageEvent) {
+	for _, s := range f.subscribers {
+		if s.filter != nil && !s.filter(&e) {
+			continue
+		}
+		if s.dropped > 0 {
+			select {
+			case s.ch <- StorageEvent{Type: EventOverflow, Dropped: s.dropped}:
+				s.dropped = 0
+			default:
+				s.dropped++
+				continue
+			}
+		}
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
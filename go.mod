@@ -1,3 +1,3 @@
 module github.com/indyjo/cafs
 
-go 1.12
+go 1.24
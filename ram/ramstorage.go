@@ -20,6 +20,7 @@ package ram
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	. "github.com/indyjo/cafs"
@@ -35,7 +36,16 @@ type ramStorage struct {
 	entries             map[SKey]*ramEntry
 	bytesUsed, bytesMax int64
 	bytesLocked         int64
+	evictions           int64
 	youngest, oldest    SKey
+	waiters             map[SKey]*ramWaiters
+	events              EventFeed
+}
+
+// Struct ramWaiters is shared by all parties waiting for the same key.
+type ramWaiters struct {
+	stored chan struct{} // Closed when the key has been stored
+	count  int           // Number of parties waiting
 }
 
 type ramFile struct {
@@ -92,13 +102,20 @@ func NewRamStorage(maxBytes int64) BoundedStorage {
 	return &ramStorage{
 		entries:  make(map[SKey]*ramEntry),
 		bytesMax: maxBytes,
+		waiters:  make(map[SKey]*ramWaiters),
 	}
 }
 
 func (s *ramStorage) GetUsageInfo() UsageInfo {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return UsageInfo{Used: s.bytesUsed, Capacity: s.bytesMax, Locked: s.bytesLocked}
+	return UsageInfo{
+		Used:      s.bytesUsed,
+		Capacity:  s.bytesMax,
+		Locked:    s.bytesLocked,
+		Entries:   len(s.entries),
+		Evictions: s.evictions,
+	}
 }
 
 func (s *ramStorage) FreeCache() int64 {
@@ -113,11 +130,7 @@ func (s *ramStorage) Get(key *SKey) (File, error) {
 	s.mutex.Lock()
 	entry, ok := s.entries[*key]
 	if ok {
-		if entry.refs == 0 {
-			s.removeFromChain(key, entry)
-			s.bytesLocked += entry.storageSize()
-		}
-		entry.refs++
+		s.lock(key, entry)
 	}
 	s.mutex.Unlock()
 	if ok {
@@ -125,7 +138,57 @@ func (s *ramStorage) Get(key *SKey) (File, error) {
 	} else {
 		return nil, ErrNotFound
 	}
-	return nil, nil // never reached
+}
+
+func (s *ramStorage) WaitFor(ctx context.Context, key *SKey) (File, error) {
+	for {
+		s.mutex.Lock()
+		entry, ok := s.entries[*key]
+		if ok {
+			s.lock(key, entry)
+			s.mutex.Unlock()
+			return &ramFile{s, *key, entry, false}, nil
+		}
+		w := s.waiters[*key]
+		if w == nil {
+			w = &ramWaiters{stored: make(chan struct{})}
+			s.waiters[*key] = w
+		}
+		w.count++
+		s.mutex.Unlock()
+
+		select {
+		case <-w.stored:
+			// The entry might have been evicted again before we get to lock it. Retry.
+		case <-ctx.Done():
+			s.mutex.Lock()
+			w.count--
+			if w.count == 0 && s.waiters[*key] == w {
+				delete(s.waiters, *key)
+			}
+			s.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *ramStorage) Subscribe(filter StorageEventFilter) <-chan StorageEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.events.Subscribe(filter)
+}
+
+func (s *ramStorage) Unsubscribe(ch <-chan StorageEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events.Unsubscribe(ch)
+}
+
+// Publishes an event concerning an entry. Must be called while holding the mutex.
+func (s *ramStorage) publish(t StorageEventType, key *SKey, entry *ramEntry) {
+	if s.events.Active() {
+		s.events.Publish(StorageEvent{Type: t, Key: *key, Size: entry.storageSize(), Info: entry.info})
+	}
 }
 
 func (s *ramStorage) Create(info string) Temporary {
@@ -190,6 +253,8 @@ func (s *ramStorage) reserveBytes(info string, numBytes int64) error {
 		}
 		s.removeFromChain(&s.oldest, oldestEntry)
 		delete(s.entries, oldestKey)
+		s.evictions++
+		s.publish(EventEvicted, &oldestKey, oldestEntry)
 
 		oldLocked := s.bytesLocked
 		// Dereference all referenced chunks
@@ -230,6 +295,7 @@ func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info
 
 		// Ref the reused entry.
 		s.lock(key, oldEntry)
+		s.publish(EventRecycled, key, oldEntry)
 
 		// Unref all referenced chunks
 		for _, chunk := range chunks {
@@ -254,6 +320,13 @@ func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info
 		s.entries[*key] = newEntry
 		s.bytesUsed += newEntry.storageSize()
 		s.bytesLocked += newEntry.storageSize()
+		s.publish(EventStored, key, newEntry)
+
+		// Wake up everybody waiting for the key
+		if w := s.waiters[*key]; w != nil {
+			close(w.stored)
+			delete(s.waiters, *key)
+		}
 		if LoggingEnabled {
 			log.Printf("[%v] Stored key: %v (data: %d bytes, chunks: %d)", info, key, len(data), len(chunks))
 		}
@@ -300,6 +373,7 @@ func (s *ramStorage) lock(key *SKey, entry *ramEntry) {
 	if entry.refs == 0 {
 		s.removeFromChain(key, entry)
 		s.bytesLocked += entry.storageSize()
+		s.publish(EventLocked, key, entry)
 	}
 	entry.refs++
 }
@@ -320,6 +394,7 @@ func (s *ramStorage) release(key *SKey, entry *ramEntry) {
 	if entry.refs == 0 {
 		s.bytesLocked -= entry.storageSize()
 		s.insertIntoChain(key, entry)
+		s.publish(EventReleased, key, entry)
 	}
 }
 
@@ -1,11 +1,13 @@
 package ram
 
 import (
+	"context"
 	"fmt"
 	. "github.com/indyjo/cafs"
 	"io"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestSimple(t *testing.T) {
@@ -212,3 +214,147 @@ func addRandomData(t *testing.T, s FileStorage, size int) File {
 	}
 	return temp.File()
 }
+
+func TestWaitFor(t *testing.T) {
+	s := NewRamStorage(1000)
+	data := make([]byte, 128)
+	rand.Read(data)
+	temp := s.Create("expected")
+	_, _ = temp.Write(data)
+	_ = temp.Close()
+	f := temp.File()
+	key := f.Key()
+	f.Dispose()
+	temp.Dispose()
+	s.FreeCache()
+	if _, err := s.Get(&key); err != ErrNotFound {
+		t.Fatalf("Expected file to be removed, got %v", err)
+	}
+
+	// Start waiting before the file exists
+	result := make(chan File)
+	for i := 0; i < 3; i++ {
+		go func() {
+			f, err := s.(WaitableStorage).WaitFor(context.Background(), &key)
+			if err != nil {
+				t.Errorf("Error waiting: %v", err)
+			}
+			result <- f
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	temp = s.Create("awaited")
+	_, _ = temp.Write(data)
+	_ = temp.Close()
+	temp.Dispose()
+	for i := 0; i < 3; i++ {
+		select {
+		case f := <-result:
+			if f.Key() != key {
+				t.Errorf("Unexpected key: %v", f.Key())
+			}
+			f.Dispose()
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for file")
+		}
+	}
+
+	// Waiting for existing files returns immediately, waiting for missing files can be cancelled
+	if f, err := s.(WaitableStorage).WaitFor(context.Background(), &key); err != nil {
+		t.Errorf("Error waiting for existing file: %v", err)
+	} else {
+		f.Dispose()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.(WaitableStorage).WaitFor(ctx, &SKey{1, 2, 3}); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if n := len(s.(*ramStorage).waiters); n != 0 {
+		t.Errorf("Expected no waiters to remain, got %d", n)
+	}
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got %d", locked)
+	}
+}
+
+// Returns the events received so far.
+func drainEvents(ch <-chan StorageEvent) []StorageEvent {
+	var result []StorageEvent
+	for {
+		select {
+		case e := <-ch:
+			result = append(result, e)
+		default:
+			return result
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := NewRamStorage(1000).(ObservableStorage)
+	all := s.Subscribe(nil)
+	defer s.Unsubscribe(all)
+
+	f := addData(t, s, 128)
+	key := f.Key()
+	ofKey := s.Subscribe(func(e *StorageEvent) bool { return e.Key == key })
+	evictions := s.Subscribe(EventTypes(EventEvicted))
+
+	f2 := addData(t, s, 128)
+	f2.Dispose()
+	f.Dispose()
+	s.(BoundedStorage).FreeCache()
+
+	var types []StorageEventType
+	for _, e := range drainEvents(ofKey) {
+		types = append(types, e.Type)
+	}
+	expected := []StorageEventType{EventRecycled, EventReleased, EventEvicted}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Errorf("Expected events %v, got %v", expected, types)
+	}
+	if events := drainEvents(evictions); len(events) != 1 || events[0].Key != key || events[0].Size == 0 {
+		t.Errorf("Unexpected evictions: %v", events)
+	}
+	if ui := s.(BoundedStorage).GetUsageInfo(); ui.Evictions != 1 || ui.Entries != 0 {
+		t.Errorf("Unexpected usage info: %#v", ui)
+	}
+	if events := drainEvents(all); len(events) == 0 || events[0].Type != EventStored {
+		t.Errorf("Unexpected events: %v", events)
+	}
+
+	s.Unsubscribe(ofKey)
+	if _, ok := <-ofKey; ok {
+		t.Errorf("Expected channel to be closed")
+	}
+	s.Unsubscribe(evictions)
+}
+
+func TestEventOverflow(t *testing.T) {
+	defer func(n int) { EventBufferSize = n }(EventBufferSize)
+	EventBufferSize = 2
+	s := NewRamStorage(10000).(ObservableStorage)
+	ch := s.Subscribe(EventTypes(EventStored))
+	defer s.Unsubscribe(ch)
+
+	for i := 1; i <= 5; i++ {
+		addData(t, s, i).Dispose()
+	}
+	if events := drainEvents(ch); len(events) != 2 || events[0].Type != EventStored || events[1].Type != EventStored {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+
+	// Events not accepted by the subscriber don't deliver the overflow notification
+	s.(BoundedStorage).FreeCache()
+	if events := drainEvents(ch); len(events) != 0 {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+
+	// The next event accepted is preceded by an overflow notification
+	addData(t, s, 6).Dispose()
+	events := drainEvents(ch)
+	if len(events) != 2 || events[0].Type != EventOverflow || events[0].Dropped != 3 || events[1].Type != EventStored {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+}
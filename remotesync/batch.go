@@ -0,0 +1,187 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+// Struct Batch contains the information two CAFS instances have to agree on before transmitting
+// a number of files in one go. The chunks of all files are treated as one long sequence, so that
+// there is only one wishlist and every distinct chunk is transmitted at most once.
+type Batch struct {
+	Files []*SyncInfo         // chunks of the individual files (their permutations are not used)
+	Perm  shuffle.Permutation // the permutation of chunks to use when transferring
+}
+
+// Function NewBatch prepares a batch for transmitting a set of CAFS files.
+func NewBatch(files []cafs.File, perm shuffle.Permutation) *Batch {
+	b := &Batch{Files: make([]*SyncInfo, len(files))}
+	b.Perm = append(b.Perm, perm...)
+	for i, file := range files {
+		b.Files[i] = &SyncInfo{}
+		b.Files[i].SetChunksFromFile(file)
+	}
+	return b
+}
+
+// Returns a SyncInfo describing the concatenated chunks of all files in the batch.
+func (b *Batch) SyncInfo() *SyncInfo {
+	s := &SyncInfo{Perm: b.Perm}
+	for _, f := range b.Files {
+		s.Chunks = append(s.Chunks, f.Chunks...)
+	}
+	return s
+}
+
+// Function ChunksOfFiles returns the chunks of a sequence of files, one file after the other, as an
+// implementation of the Chunks interface. It's the caller's responsibility to call Dispose() on the
+// returned object. The files must not be disposed before that.
+func ChunksOfFiles(files []cafs.File) Chunks {
+	return &chunksOfFiles{files: files}
+}
+
+type chunksOfFiles struct {
+	files []cafs.File       // files not yet iterated
+	iter  cafs.FileIterator // iterator of the current file, or nil
+}
+
+func (c *chunksOfFiles) NextChunk() (cafs.File, error) {
+	for {
+		if c.iter == nil {
+			if len(c.files) == 0 {
+				return nil, io.EOF
+			}
+			c.iter = c.files[0].Chunks()
+			c.files = c.files[1:]
+		}
+		if c.iter.Next() {
+			return c.iter.File(), nil
+		}
+		c.iter.Dispose()
+		c.iter = nil
+	}
+}
+
+func (c *chunksOfFiles) Dispose() {
+	if c.iter != nil {
+		c.iter.Dispose()
+		c.iter = nil
+	}
+	c.files = nil
+}
+
+// Type BatchBuilder contains state needed for the duration of a batch transmission. It acts like a Builder
+// for the concatenation of all files in the batch, but reconstructs the files individually.
+type BatchBuilder struct {
+	*Builder
+	batch *Batch
+}
+
+// Returns a new BatchBuilder for reconstructing all files of a batch. Must eventually be disposed.
+func NewBatchBuilder(storage cafs.FileStorage, batch *Batch, windowSize int, info string) *BatchBuilder {
+	return &BatchBuilder{
+		Builder: NewBuilder(storage, batch.SyncInfo(), windowSize, info),
+		batch:   batch,
+	}
+}
+
+// Reads a sequence of length-prefixed data chunks and tries to reconstruct the batch's files from that
+// information. The files are returned in the order given by the batch and must be disposed.
+func (b *BatchBuilder) ReconstructFilesFromRequestedChunks(r io.Reader) ([]cafs.File, error) {
+	// Number of chunks to expect per file. Empty files are represented by the empty chunk, which
+	// never leaves the unshuffler.
+	counts := make([]int, len(b.batch.Files))
+	for i, f := range b.batch.Files {
+		for _, ci := range f.Chunks {
+			if ci != emptyChunkInfo {
+				counts[i]++
+			}
+		}
+	}
+
+	files := make([]cafs.File, 0, len(counts))
+	success := false
+	defer func() {
+		if !success {
+			for _, f := range files {
+				f.Dispose()
+			}
+		}
+	}()
+
+	var temp cafs.Temporary
+	var remaining int
+	defer func() {
+		if temp != nil {
+			temp.Dispose()
+		}
+	}()
+
+	// Function advance completes all files whose chunks have been received and starts the next
+	// file that expects chunks.
+	advance := func() error {
+		for remaining == 0 {
+			if temp != nil {
+				if err := temp.Close(); err != nil {
+					return err
+				}
+				file := temp.File()
+				temp.Dispose()
+				temp = nil
+				if err := b.batch.Files[len(files)].Verify(file.Key(), file.Size()); err != nil {
+					file.Dispose()
+					return err
+				}
+				files = append(files, file)
+			}
+			if len(files) == len(counts) {
+				return nil
+			}
+			temp = b.storage.Create(fmt.Sprintf("%v [%d]", b.info, len(files)))
+			remaining = counts[len(files)]
+		}
+		return nil
+	}
+
+	if err := advance(); err != nil {
+		return nil, err
+	}
+	if err := b.reconstruct(r, func(chunk cafs.File) error {
+		if temp == nil {
+			return ErrUnexpectedChunk
+		}
+		if err := appendChunk(temp, chunk); err != nil {
+			return err
+		}
+		remaining--
+		return advance()
+	}); err != nil {
+		return nil, err
+	}
+	if len(files) != len(counts) {
+		return nil, errors.New("chunk data ended prematurely")
+	}
+
+	success = true
+	return files, nil
+}
@@ -0,0 +1,108 @@
+package remotesync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+func TestBatch(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	dataA := randomBytes(256 * 1024)
+	dataB := append(append([]byte{}, dataA[:200*1024]...), randomBytes(8*1024)...)
+	var files []cafs.File
+	for _, data := range [][]byte{dataA, {}, dataB, randomBytes(100), dataA, {}} {
+		f := addFile(t, storeA, data)
+		defer f.Dispose()
+		files = append(files, f)
+	}
+
+	// The amount of distinct chunk data in the batch
+	distinct := make(map[cafs.SKey]bool)
+	var distinctBytes int64
+	for _, f := range files {
+		iter := f.Chunks()
+		for iter.Next() {
+			if !distinct[iter.Key()] {
+				distinct[iter.Key()] = true
+				distinctBytes += iter.Size()
+			}
+		}
+		iter.Dispose()
+	}
+
+	for _, permSize := range []int{1, 7, 100} {
+		perm := shuffle.Permutation(rand.Perm(permSize))
+		batch := NewBatch(files, perm)
+		builder := NewBatchBuilder(storeB, batch, 8, fmt.Sprintf("batch(%d)", permSize))
+
+		pipeReader1, pipeWriter1 := io.Pipe()
+		pipeReader2, pipeWriter2 := io.Pipe()
+		go func() {
+			if err := builder.WriteWishList(NopFlushWriter{pipeWriter1}); err != nil {
+				_ = pipeWriter1.CloseWithError(err)
+			} else {
+				_ = pipeWriter1.Close()
+			}
+		}()
+		var senderStats TransferStats
+		senderDone := make(chan struct{})
+		go func() {
+			defer close(senderDone)
+			chunks := ChunksOfFiles(files)
+			defer chunks.Dispose()
+			sender := Sender{Observer: TransferObserverFunc(func(s TransferStats) { senderStats = s })}
+			if err := sender.WriteChunkData(chunks, 0, bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil); err != nil {
+				_ = pipeWriter2.CloseWithError(err)
+			} else {
+				_ = pipeWriter2.Close()
+			}
+		}()
+
+		received, err := builder.ReconstructFilesFromRequestedChunks(pipeReader2)
+		check(t, "reconstructing batch", err)
+		<-senderDone
+		stats := builder.Stats()
+		builder.Dispose()
+		if len(received) != len(files) {
+			t.Fatalf("Expected %d files, got %d", len(files), len(received))
+		}
+		for i, f := range received {
+			if f.Key() != files[i].Key() {
+				t.Errorf("File %d differs", i)
+			}
+			f.Dispose()
+		}
+
+		// Both sides agree on what happened
+		if !stats.Done() || !senderStats.Done() {
+			t.Errorf("Transfer not done: %v / %v", stats, senderStats)
+		}
+		if stats.ChunksTotal != senderStats.ChunksTotal || stats.BytesTotal != senderStats.BytesTotal ||
+			stats.ChunksRequested != senderStats.ChunksRequested || stats.ChunksReused != senderStats.ChunksReused ||
+			stats.BytesTransferred != senderStats.BytesTransferred {
+			t.Errorf("Receiver stats %#v don't match sender stats %#v", stats, senderStats)
+		}
+		if stats.BytesRequested+stats.BytesReused != stats.BytesTotal {
+			t.Errorf("Requested and reused bytes don't add up: %#v", stats)
+		}
+
+		// Only the first batch needs to transmit data, and every chunk at most once.
+		transferred := stats.BytesTransferred
+		if permSize == 1 && transferred != distinctBytes {
+			t.Errorf("Expected %d bytes to be transferred, got %d", distinctBytes, transferred)
+		} else if permSize != 1 && transferred != 0 {
+			t.Errorf("Expected no bytes to be transferred, got %d", transferred)
+		}
+	}
+}
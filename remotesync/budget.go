@@ -0,0 +1,154 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/indyjo/cafs"
+)
+
+// Struct MemoryBudget limits the number of bytes that Builders sharing it may keep locked in storage
+// at the same time. Each Builder reserves its worst-case footprint before starting and releases it
+// when disposed. A MemoryBudget is safe for concurrent use.
+type MemoryBudget struct {
+	mutex    sync.Mutex
+	limit    int64
+	reserved int64
+}
+
+// Returns a new MemoryBudget of `limit` bytes. Typically, the limit is chosen somewhat lower than the
+// capacity of the storage the Builders write into.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Returns the total number of bytes managed by the MemoryBudget.
+func (m *MemoryBudget) Limit() int64 {
+	return m.limit
+}
+
+// Returns the number of bytes not currently reserved.
+func (m *MemoryBudget) Available() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.limit - m.reserved
+}
+
+// Reserves `n` bytes. Fails with an error wrapping cafs.ErrNotEnoughSpace if fewer are available.
+func (m *MemoryBudget) Reserve(n int64) error {
+	_, err := m.reserveFitting(func(available int64) (int64, error) {
+		if n > available {
+			return 0, fmt.Errorf("%w: %d bytes requested, %d bytes available", cafs.ErrNotEnoughSpace, n, available)
+		}
+		return n, nil
+	})
+	return err
+}
+
+// Releases `n` previously reserved bytes.
+func (m *MemoryBudget) Release(n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if n > m.reserved {
+		panic("more bytes released than reserved")
+	}
+	m.reserved -= n
+}
+
+// Lets function `fit` choose an amount of bytes to reserve, given the bytes available, and reserves
+// that amount atomically. Returns the amount reserved.
+func (m *MemoryBudget) reserveFitting(fit func(available int64) (int64, error)) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n, err := fit(m.limit - m.reserved)
+	if err != nil {
+		return 0, err
+	}
+	m.reserved += n
+	return n, nil
+}
+
+// Struct footprint calculates the number of bytes a Builder may keep locked in storage at most.
+type footprint struct {
+	// Prefix sums over the chunk sizes in descending order: sums[n] is the size of the n largest chunks.
+	sums []int64
+	// The number of chunks the unshuffler may keep locked, plus the memos being processed by the
+	// goroutines writing the wishlist and reconstructing the file.
+	fixed int
+}
+
+func newFootprint(syncinf *SyncInfo) footprint {
+	sizes := make([]int64, 0, len(syncinf.Chunks))
+	for _, ci := range syncinf.Chunks {
+		if ci != emptyChunkInfo {
+			sizes = append(sizes, int64(ci.Size))
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+	sums := make([]int64, len(sizes)+1)
+	for i, size := range sizes {
+		sums[i+1] = sums[i] + size
+	}
+	return footprint{sums: sums, fixed: len(syncinf.Perm) + 2}
+}
+
+// Returns the worst-case number of bytes locked by a Builder with the given window size. At any
+// time, the Builder keeps a chunk locked for every memo in the window, for every chunk buffered in
+// the unshuffler, and for the memos currently being processed. These can't be larger than the same
+// number of largest chunks in the file.
+func (f footprint) forWindow(window int) int64 {
+	n := window + f.fixed
+	if n >= len(f.sums) {
+		n = len(f.sums) - 1
+	}
+	return f.sums[n]
+}
+
+// Returns the largest window size in [minWindow, maxWindow] for which the footprint doesn't exceed
+// `available` bytes, or 0 if there is none.
+func (f footprint) fittingWindow(minWindow, maxWindow int, available int64) int {
+	for window := maxWindow; window >= minWindow; window-- {
+		if f.forWindow(window) <= available {
+			return window
+		}
+	}
+	return 0
+}
+
+// Returns the smallest window an adaptive Builder may shrink to without stalling the transmission. With
+// the bit encoding, bits only reach the sender in complete bytes, so the window must accommodate the
+// memos of the remaining bits of a byte.
+func minWindow(enc WishlistEncoding) int {
+	if enc == RunLengthWishlist {
+		return 1
+	}
+	return 8
+}
+
+// Returns the number of bytes that can be locked in `storage` without exceeding its capacity, or
+// math.MaxInt64 if the storage is not bounded.
+func unlockedCapacity(storage cafs.FileStorage) int64 {
+	if bounded, ok := storage.(cafs.BoundedStorage); ok {
+		ui := bounded.GetUsageInfo()
+		return ui.Capacity - ui.Locked
+	}
+	return math.MaxInt64
+}
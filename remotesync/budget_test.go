@@ -0,0 +1,129 @@
+package remotesync
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(1000)
+	check(t, "reserving", budget.Reserve(600))
+	if err := budget.Reserve(600); !errors.Is(err, cafs.ErrNotEnoughSpace) {
+		t.Fatalf("Expected ErrNotEnoughSpace, got %v", err)
+	}
+	budget.Release(600)
+	check(t, "reserving again", budget.Reserve(1000))
+	if budget.Available() != 0 {
+		t.Fatalf("Expected budget to be exhausted, %d bytes available", budget.Available())
+	}
+}
+
+// Returns a SyncInfo with chunk sizes 1, 2, ..., n and a permutation of length k.
+func footprintSyncInfo(n, k int) *SyncInfo {
+	syncinf := &SyncInfo{}
+	for i := 1; i <= n; i++ {
+		syncinf.Chunks = append(syncinf.Chunks, ChunkInfo{Key: cafs.SKey{byte(i)}, Size: i})
+	}
+	syncinf.Chunks = append(syncinf.Chunks, emptyChunkInfo)
+	syncinf.SetPermutation(shuffle.Random(k, rand.New(rand.NewSource(1))))
+	return syncinf
+}
+
+func TestBuilderReserve(t *testing.T) {
+	store := NewRamStorage(1 << 20)
+	syncinf := footprintSyncInfo(100, 8)
+
+	// 8 memos, 8 chunks in the unshuffler and 2 in flight: 100+99+...+83
+	const expected = 18 * (100 + 83) / 2
+	budget := NewMemoryBudget(expected)
+	b := NewBuilder(store, syncinf, 8, "exact fit").WithMemoryBudget(budget, false)
+	check(t, "reserving exact fit", b.Reserve())
+	check(t, "reserving twice", b.Reserve())
+	if budget.Available() != 0 {
+		t.Errorf("Expected %d bytes to be reserved, %d bytes left", expected, budget.Available())
+	}
+	b.Dispose()
+	if budget.Available() != expected {
+		t.Errorf("Expected reservation to be released, %d bytes available", budget.Available())
+	}
+
+	// Without an adaptive window, the Builder fails early
+	b = NewBuilder(store, syncinf, 9, "too large").WithMemoryBudget(budget, false)
+	if err := b.Reserve(); !errors.Is(err, cafs.ErrNotEnoughSpace) {
+		t.Errorf("Expected ErrNotEnoughSpace, got %v", err)
+	}
+	if err := b.WriteWishList(NopFlushWriter{W: io.Discard}); !errors.Is(err, cafs.ErrNotEnoughSpace) {
+		t.Errorf("Expected WriteWishList to fail with ErrNotEnoughSpace, got %v", err)
+	}
+	b.Dispose()
+
+	// With an adaptive window, it shrinks the window
+	b = NewBuilder(store, syncinf, 32, "adaptive").WithMemoryBudget(budget, true)
+	check(t, "reserving with adaptive window", b.Reserve())
+	if b.Window() != 8 {
+		t.Errorf("Expected window to shrink to 8, got %d", b.Window())
+	}
+	b.Dispose()
+
+	// ... but not below the minimum window of the wishlist encoding
+	b = NewBuilder(store, syncinf, 32, "too small").WithMemoryBudget(NewMemoryBudget(expected-1), true)
+	if err := b.Reserve(); !errors.Is(err, cafs.ErrNotEnoughSpace) {
+		t.Errorf("Expected ErrNotEnoughSpace, got %v", err)
+	}
+	b.Dispose()
+
+	// A bounded storage limits the footprint even without a budget
+	b = NewBuilder(NewRamStorage(1000), syncinf, 8, "small storage")
+	if err := b.Reserve(); !errors.Is(err, cafs.ErrNotEnoughSpace) {
+		t.Errorf("Expected ErrNotEnoughSpace, got %v", err)
+	}
+	b.Dispose()
+}
+
+func TestAdaptiveWindow(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	fileA := addFile(t, storeA, randomBytes(1024*1024))
+	defer fileA.Dispose()
+
+	perm := shuffle.Random(16, rand.New(rand.NewSource(1)))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+
+	// Allow for a window of two memos only, which requires the run-length encoding
+	budget := NewMemoryBudget(newFootprint(syncinf).forWindow(2))
+	builder := NewBuilder(storeB, syncinf, 32, "adaptive window").
+		WithWishlistEncoding(RunLengthWishlist).
+		WithMemoryBudget(budget, true)
+	defer builder.Dispose()
+	check(t, "reserving", builder.Reserve())
+	if builder.Window() != 2 {
+		t.Fatalf("Expected window of 2, got %d", builder.Window())
+	}
+
+	pipeReader1, pipeWriter1 := io.Pipe()
+	pipeReader2, pipeWriter2 := io.Pipe()
+	go func() {
+		_ = pipeWriter1.CloseWithError(builder.WriteWishList(NopFlushWriter{pipeWriter1}))
+	}()
+	go func() {
+		chunks := ChunksOfFile(fileA)
+		defer chunks.Dispose()
+		sender := Sender{Encoding: RunLengthWishlist}
+		err := sender.WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil)
+		_ = pipeWriter2.CloseWithError(err)
+	}()
+
+	fileB, err := builder.ReconstructFileFromRequestedChunks(pipeReader2)
+	check(t, "reconstructing", err)
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+}
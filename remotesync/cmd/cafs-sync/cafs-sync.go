@@ -0,0 +1,257 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command cafs-sync transfers files between CAFS instances over any full-duplex stream.
+//
+// Usage:
+//
+//	cafs-sync serve [-l addr] file...
+//	cafs-sync fetch (-c addr | -- command args...) [-b basis]... -k key... -o path
+//
+// If more than one key is given, all files are fetched in a single batch and stored into directory
+// "path", named by their keys.
+//
+// Without -l, "serve" runs a single session over stdin/stdout, so that files can be fetched
+// over SSH:
+//
+//	cafs-sync fetch -k <key> -o out.bin -- ssh host cafs-sync serve /path/to/file
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+// Type stringList collects the values of a repeated command-line flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Struct pipeConn combines a reader and a writer into a full-duplex stream.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+	close func() error
+}
+
+func (c pipeConn) Close() error {
+	err := c.WriteCloser.Close()
+	if c.close != nil {
+		if err2 := c.close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func main() {
+	// Standard output is reserved for the protocol
+	log.SetOutput(os.Stderr)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serve(os.Args[2:])
+	case "fetch":
+		err = fetch(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatalf("%v: %v", os.Args[1], err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %v serve [-l addr] file...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %v fetch (-c addr | -- command args...) [-b basis]... -k key... -o path\n", os.Args[0])
+	os.Exit(2)
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("l", "", "TCP address to listen on (default: serve a single session on stdin/stdout)")
+	capacity := flags.Int64("m", 1024, "storage capacity in MiB")
+	flags.BoolVar(&remotesync.LoggingEnabled, "enable-remotesync-logging", remotesync.LoggingEnabled,
+		"enables detailed logging from the remotesync algorithm")
+	_ = flags.Parse(args)
+
+	storage := ram.NewRamStorage(*capacity << 20)
+	for _, path := range flags.Args() {
+		file, err := httpsync.LoadFile(storage, path)
+		if err != nil {
+			return err
+		}
+		// Keep the file locked for as long as we're serving
+		defer file.Dispose()
+		log.Printf("Serving %v as %v", path, file.Key())
+	}
+
+	printer := log.New(os.Stderr, "", log.LstdFlags)
+	if *addr == "" {
+		return remotesync.NewSession(pipeConn{Reader: os.Stdin, WriteCloser: os.Stdout}).
+			WithPrinter(printer).
+			Serve(storage, nil)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Listening on %v", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			session := remotesync.NewSession(conn).WithPrinter(printer)
+			defer session.Close()
+			if err := session.Serve(storage, nil); err != nil {
+				log.Printf("Session with %v failed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func fetch(args []string) error {
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	addr := flags.String("c", "", "TCP address to connect to")
+	path := flags.String("o", "", "path of the output file (or directory, if more than one key is given)")
+	capacity := flags.Int64("m", 1024, "storage capacity in MiB")
+	var hashes, basis stringList
+	flags.Var(&hashes, "k", "key of the file to fetch (repeatable)")
+	flags.Var(&basis, "b", "local file that possibly shares content with the files to fetch (repeatable)")
+	_ = flags.Parse(args)
+
+	keys := make([]cafs.SKey, len(hashes))
+	for i, hash := range hashes {
+		if key, err := cafs.ParseKey(hash); err != nil {
+			return fmt.Errorf("invalid key %v: %v", hash, err)
+		} else {
+			keys[i] = *key
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no key given")
+	}
+	if *path == "" {
+		return fmt.Errorf("no output path given")
+	}
+
+	storage := ram.NewRamStorage(*capacity << 20)
+	for _, b := range basis {
+		file, err := httpsync.LoadFile(storage, b)
+		if err != nil {
+			return err
+		}
+		defer file.Dispose()
+	}
+
+	var conn io.ReadWriteCloser
+	var err error
+	if *addr != "" {
+		if conn, err = net.Dial("tcp", *addr); err != nil {
+			return err
+		}
+	} else if flags.NArg() > 0 {
+		if conn, err = startCommand(flags.Args()); err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("neither address nor command given")
+	}
+
+	session := remotesync.NewSession(conn)
+	defer session.Close()
+	files, err := session.FetchAll(context.Background(), storage, keys, "fetched")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Dispose()
+		}
+	}()
+
+	if len(keys) == 1 {
+		return httpsync.SaveFile(storage, keys[0].String(), *path)
+	}
+	if err := os.MkdirAll(*path, 0777); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		// Duplicate keys are saved only once
+		if j := indexOf(keys, key); j < i {
+			continue
+		}
+		if err := httpsync.SaveFile(storage, key.String(), filepath.Join(*path, key.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexOf(keys []cafs.SKey, key cafs.SKey) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Function startCommand runs a command and returns a stream connected to its stdin and stdout.
+func startCommand(args []string) (io.ReadWriteCloser, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return pipeConn{Reader: stdout, WriteCloser: stdin, close: cmd.Wait}, nil
+}
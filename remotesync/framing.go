@@ -0,0 +1,135 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frames larger than this are split when writing and rejected when reading.
+const maxFrameSize = 64 * 1024
+
+// Struct frameWriter embeds a finite byte stream into a longer-lived stream by splitting it into
+// frames, each prefixed with its length as uvarint. A frame of length zero terminates the stream.
+// Implements FlushWriter. Bytes written are buffered until Flush() is called.
+type frameWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func newFrameWriter(w *bufio.Writer) *frameWriter {
+	return &frameWriter{w: w}
+}
+
+func (f *frameWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		l := maxFrameSize - len(f.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		f.buf = append(f.buf, p[:l]...)
+		p = p[l:]
+		n += l
+		if len(f.buf) == maxFrameSize {
+			if err = f.writeFrame(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Writes the buffered bytes as one frame, if there are any.
+func (f *frameWriter) writeFrame() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	var lbuf [binary.MaxVarintLen64]byte
+	if _, err := f.w.Write(lbuf[:binary.PutUvarint(lbuf[:], uint64(len(f.buf)))]); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(f.buf); err != nil {
+		return err
+	}
+	f.buf = f.buf[:0]
+	return nil
+}
+
+// Writes buffered bytes and flushes the underlying writer. Errors are reported by the next
+// call to Write or Close.
+func (f *frameWriter) Flush() {
+	if f.writeFrame() == nil {
+		_ = f.w.Flush()
+	}
+}
+
+// Writes buffered bytes, followed by the terminating empty frame, and flushes the underlying writer.
+// The underlying writer is not closed.
+func (f *frameWriter) Close() error {
+	if err := f.writeFrame(); err != nil {
+		return err
+	}
+	if err := f.w.WriteByte(0); err != nil {
+		return err
+	}
+	return f.w.Flush()
+}
+
+// Struct frameReader reads a stream written by a frameWriter and returns io.EOF after the
+// terminating frame, leaving the underlying reader positioned immediately after it.
+type frameReader struct {
+	r         *bufio.Reader
+	remaining uint64
+	eof       bool
+}
+
+func newFrameReader(r *bufio.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+func (f *frameReader) Read(p []byte) (n int, err error) {
+	if f.eof {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.remaining == 0 {
+		if f.remaining, err = binary.ReadUvarint(f.r); err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		} else if f.remaining == 0 {
+			f.eof = true
+			return 0, io.EOF
+		} else if f.remaining > maxFrameSize {
+			return 0, fmt.Errorf("illegal frame length: %v", f.remaining)
+		}
+	}
+	if uint64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err = f.r.Read(p)
+	f.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
@@ -0,0 +1,152 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Versions of the remotesync protocol.
+const (
+	// Version spoken implicitly by peers that don't perform a handshake at all. It transmits
+	// the wishlist as one bit per chunk (MSB first) and chunk lengths as signed varints.
+	LegacyProtocolVersion = 1
+	// Version implemented by this package.
+	ProtocolVersion = 2
+	// Oldest version this package is still able to speak.
+	MinProtocolVersion = LegacyProtocolVersion
+)
+
+// Names of the hash and chunking algorithms a peer can use.
+const (
+	HashSHA256     = "sha256"
+	ChunkerAdler32 = "adler32"
+)
+
+// Type Feature names an optional protocol extension. Features are only used if both peers
+// announce them during the handshake.
+type Feature string
+
+// Features supported by this package.
+var supportedFeatures []Feature
+
+// Struct Handshake describes what a peer is able to speak. Peers exchange handshakes before
+// transmitting SyncInfo and agree on a common subset using function Negotiate.
+type Handshake struct {
+	Version    int       // highest protocol version supported
+	MinVersion int       // lowest protocol version supported
+	Hash       string    // algorithm used for computing keys
+	Chunker    string    // algorithm used for content-based chunking
+	Features   []Feature `json:",omitempty"` // optional extensions supported
+}
+
+// Function LocalHandshake returns the handshake describing this implementation.
+func LocalHandshake() Handshake {
+	return Handshake{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Hash:       HashSHA256,
+		Chunker:    ChunkerAdler32,
+		Features:   append([]Feature(nil), supportedFeatures...),
+	}
+}
+
+// Function LegacyHandshake returns the handshake implicitly assumed for peers that don't
+// send one.
+func LegacyHandshake() Handshake {
+	return Handshake{
+		Version:    LegacyProtocolVersion,
+		MinVersion: LegacyProtocolVersion,
+		Hash:       HashSHA256,
+		Chunker:    ChunkerAdler32,
+	}
+}
+
+// Returns true if the handshake lists feature f.
+func (h Handshake) Supports(f Feature) bool {
+	for _, g := range h.Features {
+		if g == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Handshake) String() string {
+	features := make([]string, len(h.Features))
+	for i, f := range h.Features {
+		features[i] = string(f)
+	}
+	return fmt.Sprintf("v%d (min v%d) hash=%v chunker=%v features=[%v]",
+		h.Version, h.MinVersion, h.Hash, h.Chunker, strings.Join(features, ","))
+}
+
+// Struct IncompatibleError is returned when two peers can't agree on a common protocol.
+type IncompatibleError struct {
+	Local, Remote Handshake
+	Reason        string
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("incompatible remotesync peer: %v (local: %v, remote: %v)", e.Reason, e.Local, e.Remote)
+}
+
+// Function Negotiate computes the protocol to use between two peers. The result is symmetric,
+// i.e. both peers arrive at the same handshake when negotiating with each other's handshake.
+// Returns an *IncompatibleError if there is no common protocol.
+func Negotiate(local, remote Handshake) (Handshake, error) {
+	fail := func(format string, v ...interface{}) (Handshake, error) {
+		return Handshake{}, &IncompatibleError{local, remote, fmt.Sprintf(format, v...)}
+	}
+
+	if remote.Version < 1 || remote.MinVersion < 0 || remote.MinVersion > remote.Version {
+		return fail("invalid version range %d..%d", remote.MinVersion, remote.Version)
+	}
+	result := Handshake{
+		Version:    local.Version,
+		MinVersion: local.MinVersion,
+		Hash:       local.Hash,
+		Chunker:    local.Chunker,
+	}
+	if remote.Version < result.Version {
+		result.Version = remote.Version
+	}
+	if remote.MinVersion > result.MinVersion {
+		result.MinVersion = remote.MinVersion
+	}
+	if result.Version < result.MinVersion {
+		return fail("no common protocol version")
+	}
+	if remote.Hash != local.Hash {
+		return fail("hash algorithm %#v not supported", remote.Hash)
+	}
+	if remote.Chunker != local.Chunker {
+		return fail("chunker %#v not supported", remote.Chunker)
+	}
+	// Legacy peers don't know about features
+	if result.Version > LegacyProtocolVersion {
+		for _, f := range local.Features {
+			if remote.Supports(f) {
+				result.Features = append(result.Features, f)
+			}
+		}
+		sort.Slice(result.Features, func(i, j int) bool { return result.Features[i] < result.Features[j] })
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package remotesync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := LocalHandshake()
+	local.Features = []Feature{"b", "a", "c"}
+
+	remote := LocalHandshake()
+	remote.Version = ProtocolVersion + 3
+	remote.Features = []Feature{"c", "d", "a"}
+
+	proto, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	}
+	if proto.Version != ProtocolVersion {
+		t.Errorf("Expected version %d, got %d", ProtocolVersion, proto.Version)
+	}
+	if !reflect.DeepEqual(proto.Features, []Feature{"a", "c"}) {
+		t.Errorf("Unexpected features: %v", proto.Features)
+	}
+
+	// Negotiation must be symmetric
+	if proto2, err := Negotiate(remote, local); err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	} else if proto2.Version != proto.Version || !reflect.DeepEqual(proto2.Features, proto.Features) {
+		t.Errorf("Negotiation not symmetric: %v vs %v", proto, proto2)
+	}
+}
+
+func TestNegotiateSupportedFeatures(t *testing.T) {
+	local := LocalHandshake()
+	for _, f := range []Feature{FeatureRunLengthWishlist, FeatureSeededPermutation} {
+		if !local.Supports(f) {
+			t.Errorf("Local handshake doesn't announce %v", f)
+		}
+	}
+
+	// Two peers of this package agree on all features
+	if proto, err := Negotiate(local, LocalHandshake()); err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	} else if len(proto.Features) != len(local.Features) {
+		t.Errorf("Expected features %v, got %v", local.Features, proto.Features)
+	} else if proto.WishlistEncoding() != RunLengthWishlist {
+		t.Errorf("Expected run-length wishlist, got %v", proto.WishlistEncoding())
+	}
+
+	// A peer lacking a feature must not get it
+	remote := LocalHandshake()
+	remote.Features = []Feature{FeatureSeededPermutation, "unknown"}
+	if proto, err := Negotiate(local, remote); err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	} else if !reflect.DeepEqual(proto.Features, []Feature{FeatureSeededPermutation}) {
+		t.Errorf("Unexpected features: %v", proto.Features)
+	} else if proto.WishlistEncoding() == RunLengthWishlist {
+		t.Errorf("Run-length wishlist used without being negotiated")
+	}
+}
+
+func TestNegotiateLegacy(t *testing.T) {
+	local := LocalHandshake()
+	local.Features = []Feature{"a"}
+	remote := LegacyHandshake()
+	remote.Features = []Feature{"a"}
+	if proto, err := Negotiate(local, remote); err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	} else if proto.Version != LegacyProtocolVersion {
+		t.Errorf("Expected legacy version, got %v", proto)
+	} else if len(proto.Features) != 0 {
+		t.Errorf("Legacy protocol must not use features, got %v", proto)
+	}
+}
+
+func TestNegotiateIncompatible(t *testing.T) {
+	for _, mod := range []func(h *Handshake){
+		func(h *Handshake) { h.Version, h.MinVersion = ProtocolVersion+2, ProtocolVersion+1 },
+		func(h *Handshake) { h.Version = 0 },
+		func(h *Handshake) { h.MinVersion = h.Version + 1 },
+		func(h *Handshake) { h.Hash = "blake2b" },
+		func(h *Handshake) { h.Chunker = "rabin" },
+	} {
+		remote := LocalHandshake()
+		mod(&remote)
+		if _, err := Negotiate(LocalHandshake(), remote); err == nil {
+			t.Errorf("Expected error negotiating with %v", remote)
+		} else if _, ok := err.(*IncompatibleError); !ok {
+			t.Errorf("Expected *IncompatibleError, got %#v", err)
+		}
+	}
+}
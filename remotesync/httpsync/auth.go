@@ -0,0 +1,351 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indyjo/cafs"
+)
+
+// Type Action names what a request is going to do, for the purpose of authorization.
+type Action string
+
+const (
+	// Retrieving files, e.g. using the sync protocol or a Gateway.
+	ActionRead Action = "read"
+	// Adding files to the storage or accessing the server's file system.
+	ActionWrite Action = "write"
+	// Managing the service, e.g. withdrawing offers or resetting the storage.
+	ActionAdmin Action = "admin"
+)
+
+// Struct Identity describes an authenticated client.
+type Identity struct {
+	// Identifies the client, e.g. the owner of a token or the subject of a client certificate.
+	Name string
+	// If not nil, the client may only read the file identified by this key, regardless of any
+	// policy. Used for signed URLs.
+	Key *cafs.SKey
+}
+
+func (id *Identity) String() string {
+	if id == nil {
+		return "anonymous"
+	}
+	return id.Name
+}
+
+// Interface Authenticator determines the identity of the client sending a request.
+type Authenticator interface {
+	// Returns nil and no error if the request doesn't carry the kind of credentials checked by the
+	// Authenticator. Returns an error if it carries invalid credentials.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Type AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// Function FirstOf returns an Authenticator that tries the given Authenticators in order and
+// returns the first identity found. Any error aborts authentication.
+func FirstOf(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+		for _, a := range authenticators {
+			if id, err := a.Authenticate(r); err != nil || id != nil {
+				return id, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// Type BearerTokens authenticates requests carrying an "Authorization: Bearer <token>" header.
+// It maps tokens to the names of their owners.
+type BearerTokens map[string]string
+
+func (t BearerTokens) Authenticate(r *http.Request) (*Identity, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return nil, nil
+	}
+	token := []byte(strings.TrimPrefix(header, prefix))
+	// Compare all tokens in constant time, so that the response time doesn't reveal anything
+	var name string
+	found := false
+	for t, n := range t {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			name, found = n, true
+		}
+	}
+	if !found {
+		return nil, errors.New("invalid bearer token")
+	}
+	return &Identity{Name: name}, nil
+}
+
+// Query parameters used by signed URLs.
+const (
+	ParamKey       = "cafs-key"
+	ParamExpires   = "cafs-expires"
+	ParamSignature = "cafs-signature"
+)
+
+// Struct URLSigner creates and authenticates URLs granting read access to a single file until
+// they expire. The signature covers the file key and the expiry, but not the rest of the URL, so
+// a signed URL may be used with any endpoint serving the file.
+type URLSigner struct {
+	secret []byte
+}
+
+// Function NewURLSigner creates a URLSigner using `secret` as the HMAC key. Everybody knowing the
+// secret can create signed URLs.
+func NewURLSigner(secret []byte) *URLSigner {
+	return &URLSigner{secret: append([]byte(nil), secret...)}
+}
+
+func (s *URLSigner) signature(key cafs.SKey, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = fmt.Fprintf(mac, "%v\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Adds query parameters to `rawurl` that grant read access to the file identified by `key` until
+// `expires`.
+func (s *URLSigner) Sign(rawurl string, key cafs.SKey, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(ParamKey, key.String())
+	q.Set(ParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(ParamSignature, s.signature(key, expires.Unix()))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (s *URLSigner) Authenticate(r *http.Request) (*Identity, error) {
+	q := r.URL.Query()
+	signature := q.Get(ParamSignature)
+	if signature == "" {
+		return nil, nil
+	}
+	key, err := cafs.ParseKey(q.Get(ParamKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in signed URL: %v", err)
+	}
+	expires, err := strconv.ParseInt(q.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry in signed URL: %v", err)
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.signature(*key, expires))) {
+		return nil, errors.New("invalid signature")
+	}
+	if time.Now().Unix() > expires {
+		return nil, errors.New("signed URL expired")
+	}
+	return &Identity{Name: "signed URL for " + key.String()[:16], Key: key}, nil
+}
+
+// Struct ClientCertificates authenticates clients presenting a TLS client certificate verified by
+// the server. The identity is named after the certificate's common name.
+type ClientCertificates struct{}
+
+func (ClientCertificates) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	return &Identity{Name: r.TLS.VerifiedChains[0][0].Subject.CommonName}, nil
+}
+
+// Interface Policy decides which identities may perform which actions.
+type Policy interface {
+	// Returns true if `id` may perform `action` on the file identified by `key`. The identity is
+	// nil for anonymous clients. The key is nil if the action doesn't concern a specific file.
+	Allow(id *Identity, action Action, key *cafs.SKey) bool
+}
+
+// Type PolicyFunc adapts a function to the Policy interface.
+type PolicyFunc func(id *Identity, action Action, key *cafs.SKey) bool
+
+func (f PolicyFunc) Allow(id *Identity, action Action, key *cafs.SKey) bool {
+	return f(id, action, key)
+}
+
+// Names with a special meaning in an AccessList.
+const (
+	Anonymous = ""  // Clients that didn't authenticate
+	Anyone    = "*" // All authenticated clients
+)
+
+// Struct AccessList is a Policy granting actions to identities by name, either for all files or
+// for specific keys. Nothing is allowed unless granted. An AccessList is safe for concurrent use.
+type AccessList struct {
+	mutex  sync.Mutex
+	grants map[string]map[Action]*grant
+}
+
+type grant struct {
+	keys map[cafs.SKey]bool // nil if granted for all keys
+}
+
+// Function NewAccessList returns an empty AccessList.
+func NewAccessList() *AccessList {
+	return &AccessList{grants: make(map[string]map[Action]*grant)}
+}
+
+// Allows the identity called `name` (or Anonymous or Anyone) to perform `action`. If keys are
+// given, the action is allowed only for the files identified by them. Grants accumulate.
+func (a *AccessList) Grant(name string, action Action, keys ...cafs.SKey) *AccessList {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	actions := a.grants[name]
+	if actions == nil {
+		actions = make(map[Action]*grant)
+		a.grants[name] = actions
+	}
+	g := actions[action]
+	if g == nil {
+		g = &grant{}
+		if len(keys) > 0 {
+			g.keys = make(map[cafs.SKey]bool)
+		}
+		actions[action] = g
+	}
+	if len(keys) == 0 {
+		g.keys = nil
+	}
+	if g.keys != nil {
+		for _, key := range keys {
+			g.keys[key] = true
+		}
+	}
+	return a
+}
+
+func (a *AccessList) Allow(id *Identity, action Action, key *cafs.SKey) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	names := []string{Anonymous}
+	if id != nil {
+		names = []string{id.Name, Anyone}
+	}
+	for _, name := range names {
+		if g := a.grants[name][action]; g != nil && (g.keys == nil || key != nil && g.keys[*key]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Struct Auth combines an Authenticator and a Policy in order to protect HTTP handlers. A nil
+// *Auth allows everything.
+type Auth struct {
+	authenticator Authenticator
+	policy        Policy
+	log           cafs.Printer
+}
+
+// Function NewAuth creates an Auth using the given Authenticator and Policy.
+func NewAuth(authenticator Authenticator, policy Policy) *Auth {
+	return &Auth{
+		authenticator: authenticator,
+		policy:        policy,
+		log:           cafs.NewWriterPrinter(ioutil.Discard),
+	}
+}
+
+// Sets the Auth's log Printer, which receives all rejected requests.
+func (a *Auth) WithPrinter(printer cafs.Printer) *Auth {
+	a.log = printer
+	return a
+}
+
+type identityContextKey struct{}
+
+// Function IdentityFromContext returns the identity of the client which sent the request that
+// `ctx` belongs to, or nil if unknown.
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return id
+}
+
+// Checks whether the request may perform `action` on the file identified by `key`, or on no
+// particular file if `key` is nil. If not, writes an error response and returns nil and false.
+// Otherwise, returns the request, annotated with the client's identity, and true.
+func (a *Auth) Check(w http.ResponseWriter, r *http.Request, action Action, key *cafs.SKey) (*http.Request, bool) {
+	if a == nil {
+		return r, true
+	}
+	id, err := a.authenticator.Authenticate(r)
+	if err != nil {
+		a.log.Printf("Authentication failed for %v %v: %v", r.Method, r.URL.Path, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "authentication failed", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	var allowed bool
+	if id != nil && id.Key != nil {
+		// Scoped identities may read their file only
+		allowed = action == ActionRead && key != nil && *key == *id.Key
+	} else {
+		allowed = a.policy.Allow(id, action, key)
+	}
+	if !allowed {
+		a.log.Printf("Access denied: %v %v (%v) for %v", r.Method, r.URL.Path, action, id)
+		if id == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		} else {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+		return nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)), true
+}
+
+// Returns a handler that calls `next` only for requests allowed to perform `action`. If the
+// Auth is nil, returns `next`.
+func (a *Auth) Require(action Action, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := a.Check(w, r, action, nil); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
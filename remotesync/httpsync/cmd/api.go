@@ -0,0 +1,390 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+// The JSON API is served under this prefix. It is described in openapi.yaml.
+const apiPrefix = "/api/v1/"
+
+// Struct apiError is the body of all error responses sent by the API.
+type apiError struct {
+	Error apiErrorDetails `json:"error"`
+}
+
+type apiErrorDetails struct {
+	Status  int    `json:"status"`  // The HTTP status code
+	Code    string `json:"code"`    // A machine-readable error code
+	Message string `json:"message"` // A human-readable description
+}
+
+// Struct apiFile describes a file in the storage.
+type apiFile struct {
+	Key     cafs.SKey  `json:"key"`
+	Size    int64      `json:"size"`
+	Chunks  int64      `json:"chunks,omitempty"`  // Only known for files in storage
+	Gateway string     `json:"gateway"`           // Path under which the file is reachable by key
+	Offer   string     `json:"offer,omitempty"`   // Path under which the file is offered, if it is
+	Expires *time.Time `json:"expires,omitempty"` // When the offer expires, if it does
+}
+
+// Struct apiLoad is the body of requests loading files from the data dir.
+type apiLoad struct {
+	Path string `json:"path"`
+	TTL  string `json:"ttl,omitempty"` // Limits the duration of the offer, e.g. "1h"
+}
+
+// Struct apiSyncRequest is the body of requests starting a sync.
+type apiSyncRequest struct {
+	Source string     `json:"source,omitempty"` // The URL to sync from; if empty, peers are asked
+	Key    *cafs.SKey `json:"key,omitempty"`    // The key of the file expected, if known
+	Token  string     `json:"token,omitempty"`  // A bearer token to authenticate with at the source, never sent to peers
+}
+
+// Struct apiPeer describes a service asked for files requested by key only.
+type apiPeer struct {
+	URL       string     `json:"url"`    // The peer's base URL
+	Origin    string     `json:"origin"` // How the peer is known: "static" or "discovered"
+	Alive     bool       `json:"alive"`  // Whether a discovered peer announces itself on time
+	ID        string     `json:"id,omitempty"`
+	Capacity  int64      `json:"capacity,omitempty"`
+	Used      int64      `json:"used,omitempty"`
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+}
+
+// Struct apiUsage describes the storage's usage.
+type apiUsage struct {
+	Used     int64 `json:"used"`
+	Capacity int64 `json:"capacity"`
+	Locked   int64 `json:"locked"`
+	Offered  int   `json:"offered"` // The number of files offered
+}
+
+// Struct apiSync describes a sync job, see jobManager.
+type apiSync struct {
+	ID       string      `json:"id"`
+	Source   string      `json:"source"`
+	Status   string      `json:"status"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Key      *cafs.SKey  `json:"key,omitempty"`   // The file expected or, once succeeded, received
+	Error    string      `json:"error,omitempty"` // Why the sync failed, if it did
+	Progress apiProgress `json:"progress"`
+}
+
+// Struct apiProgress describes the progress of a sync.
+type apiProgress struct {
+	ChunksTotal       int   `json:"chunksTotal"`
+	ChunksReused      int   `json:"chunksReused"`
+	ChunksTransferred int   `json:"chunksTransferred"`
+	BytesTotal        int64 `json:"bytesTotal"`
+	BytesReused       int64 `json:"bytesReused"`
+	BytesTransferred  int64 `json:"bytesTransferred"`
+	BytesRequested    int64 `json:"bytesRequested"`
+}
+
+func progressOf(s remotesync.TransferStats) apiProgress {
+	return apiProgress{
+		ChunksTotal:       s.ChunksTotal,
+		ChunksReused:      s.ChunksReused,
+		ChunksTransferred: s.ChunksTransferred,
+		BytesTotal:        s.BytesTotal,
+		BytesReused:       s.BytesReused,
+		BytesTransferred:  s.BytesTransferred,
+		BytesRequested:    s.BytesRequested,
+	}
+}
+
+// Function apiHandler returns the handler serving the JSON API.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiPrefix+"files", apiListFiles)
+	mux.HandleFunc("POST "+apiPrefix+"files", apiLoadFile)
+	mux.HandleFunc("GET "+apiPrefix+"files/{key}", apiGetFile)
+	mux.HandleFunc("DELETE "+apiPrefix+"files/{key}", apiWithdrawFile)
+	mux.HandleFunc("GET "+apiPrefix+"syncs", apiListSyncs)
+	mux.HandleFunc("POST "+apiPrefix+"syncs", apiStartSync)
+	mux.HandleFunc("GET "+apiPrefix+"syncs/{id}", apiGetSync)
+	mux.HandleFunc("DELETE "+apiPrefix+"syncs/{id}", apiCancelSync)
+	mux.HandleFunc("GET "+apiPrefix+"usage", apiGetUsage)
+	mux.HandleFunc("GET "+apiPrefix+"peers", apiListPeers)
+	mux.HandleFunc(apiPrefix, func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such endpoint: %v %v", r.Method, r.URL.Path)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{apiErrorDetails{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}})
+}
+
+// Decodes a JSON request body into `v`. Writes an error response and returns false on failure.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_body", "invalid request body: %v", err)
+		return false
+	}
+	return true
+}
+
+// Parses the key in the request path. Writes an error response and returns nil on failure.
+func pathKey(w http.ResponseWriter, r *http.Request) *cafs.SKey {
+	key, err := cafs.ParseKey(r.PathValue("key"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_key", "invalid key: %v", err)
+		return nil
+	}
+	return key
+}
+
+func fileFromOffer(offer httpsync.Offer) apiFile {
+	return apiFile{
+		Key:     offer.Key,
+		Size:    offer.Size,
+		Gateway: "/cafs/" + offer.Key.String(),
+		Offer:   offer.Path,
+		Expires: offer.Expires,
+	}
+}
+
+// Lists the files currently offered.
+func apiListFiles(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionRead, nil); !ok {
+		return
+	}
+	offers := registry.List()
+	files := make([]apiFile, 0, len(offers))
+	for _, offer := range offers {
+		files = append(files, fileFromOffer(offer))
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// Loads a file from the data dir and offers it.
+func apiLoadFile(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionWrite, nil); !ok {
+		return
+	}
+	var req apiLoad
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_ttl", "invalid ttl: %v", err)
+			return
+		}
+	}
+	path, err := clientPath(req.Path)
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, "forbidden_path", "%v", err)
+		return
+	}
+	hash, err := loadFile(path, ttl)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "%v", err)
+		return
+	} else if errors.Is(err, cafs.ErrNotEnoughSpace) {
+		writeAPIError(w, http.StatusInsufficientStorage, "not_enough_space", "%v", err)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "load_failed", "%v", err)
+		return
+	}
+	key, _ := cafs.ParseKey(hash)
+	offer, _ := registry.Lookup(*key)
+	w.Header().Set("Location", apiPrefix+"files/"+hash)
+	writeJSON(w, http.StatusCreated, fileFromOffer(offer))
+}
+
+// Describes a file in storage, whether offered or not.
+func apiGetFile(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(w, r)
+	if key == nil {
+		return
+	}
+	if _, ok := auth.Check(w, r, httpsync.ActionRead, key); !ok {
+		return
+	}
+	file, err := currentStorage().Get(key)
+	if err == cafs.ErrNotFound {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such file: %v", key)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "%v", err)
+		return
+	}
+	defer file.Dispose()
+
+	result := apiFile{
+		Key:     *key,
+		Size:    file.Size(),
+		Chunks:  file.NumChunks(),
+		Gateway: "/cafs/" + key.String(),
+	}
+	if offer, ok := registry.Lookup(*key); ok {
+		result.Offer, result.Expires = offer.Path, offer.Expires
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Withdraws the offer of a file. The file may remain in storage.
+func apiWithdrawFile(w http.ResponseWriter, r *http.Request) {
+	key := pathKey(w, r)
+	if key == nil {
+		return
+	}
+	if _, ok := auth.Check(w, r, httpsync.ActionAdmin, key); !ok {
+		return
+	}
+	if !registry.Withdraw(*key) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "file not offered: %v", key)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListSyncs(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionWrite, nil); !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs.list())
+}
+
+// Starts syncing a file in the background, or joins the job already syncing it. Clients poll the
+// returned location for the result.
+func apiStartSync(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionWrite, nil); !ok {
+		return
+	}
+	var req apiSyncRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Source == "" && req.Key == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_source", "either source or key required")
+		return
+	}
+	job, joined := jobs.submit(req)
+	w.Header().Set("Location", apiPrefix+"syncs/"+job.ID)
+	if joined {
+		writeJSON(w, http.StatusOK, job)
+	} else {
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+func apiGetSync(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionWrite, nil); !ok {
+		return
+	}
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such sync: %v", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// Cancels a sync, affecting all clients waiting for it.
+func apiCancelSync(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionWrite, nil); !ok {
+		return
+	}
+	job, err := jobs.cancel(r.PathValue("id"))
+	if err == errNoSuchJob {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such sync: %v", r.PathValue("id"))
+		return
+	} else if err == errJobFinished {
+		writeAPIError(w, http.StatusConflict, "finished", "sync %v has already %v", job.ID, job.Status)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func apiGetUsage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionAdmin, nil); !ok {
+		return
+	}
+	bounded, ok := currentStorage().(cafs.BoundedStorage)
+	if !ok {
+		writeAPIError(w, http.StatusNotImplemented, "unbounded", "the storage doesn't report its usage")
+		return
+	}
+	ui := bounded.GetUsageInfo()
+	writeJSON(w, http.StatusOK, apiUsage{
+		Used:     ui.Used,
+		Capacity: ui.Capacity,
+		Locked:   ui.Locked,
+		Offered:  len(registry.List()),
+	})
+}
+
+func apiListPeers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := auth.Check(w, r, httpsync.ActionAdmin, nil); !ok {
+		return
+	}
+	result := make([]apiPeer, 0)
+	for _, peer := range staticPeers {
+		result = append(result, apiPeer{URL: peer, Origin: "static", Alive: true})
+	}
+	if discovery != nil {
+		for _, peer := range discovery.Peers() {
+			result = append(result, apiPeer{
+				URL:       peer.URL,
+				Origin:    "discovered",
+				Alive:     peer.Alive,
+				ID:        peer.ID,
+				Capacity:  peer.Capacity,
+				Used:      peer.Used,
+				FirstSeen: &peer.FirstSeen,
+				LastSeen:  &peer.LastSeen,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
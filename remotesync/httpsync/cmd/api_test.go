@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+// Sends a request to the API and decodes the response into `result`, if given. Returns the status.
+func call(t *testing.T, server *httptest.Server, method, path string, body interface{}, result interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, server.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var e apiError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error.Status != resp.StatusCode {
+			t.Errorf("%v %v: invalid error body (%v): %#v", method, path, err, e)
+		}
+	} else if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	dataDir = t.TempDir()
+	setStorage(ram.NewRamStorage(8 << 20))
+	defer registry.Clear()
+	server := httptest.NewServer(apiHandler())
+	defer server.Close()
+
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(dataDir, "a.bin")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var file apiFile
+	if s := call(t, server, http.MethodPost, "/api/v1/files", apiLoad{Path: path, TTL: "1h"}, &file); s != http.StatusCreated {
+		t.Fatalf("Loading returned %v", s)
+	}
+	if file.Size != int64(len(data)) || file.Offer == "" || file.Expires == nil {
+		t.Errorf("Unexpected file: %#v", file)
+	}
+	key := file.Key.String()
+
+	var files []apiFile
+	if s := call(t, server, http.MethodGet, "/api/v1/files", nil, &files); s != http.StatusOK || len(files) != 1 || files[0].Key != file.Key {
+		t.Errorf("Listing returned %v: %#v", s, files)
+	}
+	if s := call(t, server, http.MethodGet, "/api/v1/files/"+key, nil, &file); s != http.StatusOK || file.Chunks == 0 {
+		t.Errorf("Getting file returned %v: %#v", s, file)
+	}
+
+	// Paths must stay within the data dir, also via symbolic links
+	outside := filepath.Join(t.TempDir(), "b.bin")
+	if err := os.WriteFile(outside, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dataDir, "link.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside+".missing", filepath.Join(dataDir, "dangling.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		body         interface{}
+		expected     int
+	}{
+		{http.MethodGet, "/api/v1/files/xyz", nil, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/files/" + strings.Repeat("0", 64), nil, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: filepath.Join(dataDir, "missing")}, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: outside}, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: filepath.Join(dataDir, "..", "b.bin")}, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: filepath.Join(dataDir, "link.bin")}, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: filepath.Join(dataDir, "dangling.bin")}, http.StatusForbidden},
+		// Relative paths are relative to the data dir, not to the working directory
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: "a.bin"}, http.StatusCreated},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: filepath.Join("..", "b.bin")}, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/files", apiLoad{Path: "link.bin"}, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/files", map[string]string{"unknown": ""}, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/syncs", apiSyncRequest{}, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/syncs/nonexistent", nil, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/nonexistent", nil, http.StatusNotFound},
+	} {
+		if s := call(t, server, c.method, c.path, c.body, nil); s != c.expected {
+			t.Errorf("%v %v: expected %v, got %v", c.method, c.path, c.expected, s)
+		}
+	}
+
+	// Sync a file from another storage and poll until done
+	source := ram.NewRamStorage(8 << 20)
+	temp := source.Create("other")
+	_, _ = temp.Write(data[:100000])
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	handler := httpsync.NewFileHandlerFromFile(temp.File(), nil)
+	temp.Dispose()
+	defer handler.Dispose()
+	sourceServer := httptest.NewServer(handler)
+	defer sourceServer.Close()
+
+	var job apiSync
+	if s := call(t, server, http.MethodPost, "/api/v1/syncs", apiSyncRequest{Source: sourceServer.URL}, &job); s != http.StatusAccepted {
+		t.Fatalf("Starting sync returned %v", s)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for (job.Status == jobQueued || job.Status == jobRunning) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		call(t, server, http.MethodGet, "/api/v1/syncs/"+job.ID, nil, &job)
+	}
+	if job.Status != jobSucceeded || job.Key == nil || job.Progress.BytesTotal != 100000 {
+		t.Fatalf("Unexpected sync: %#v", job)
+	}
+	if s := call(t, server, http.MethodGet, "/api/v1/files/"+job.Key.String(), nil, nil); s != http.StatusOK {
+		t.Errorf("Synced file not found: %v", s)
+	}
+
+	var usage apiUsage
+	if s := call(t, server, http.MethodGet, "/api/v1/usage", nil, &usage); s != http.StatusOK || usage.Capacity != 8<<20 || usage.Offered != 1 {
+		t.Errorf("Usage returned %v: %#v", s, usage)
+	}
+
+	SetPeers([]string{"10.0.0.2:8080"}, "")
+	defer SetPeers(nil, "")
+	var peers []apiPeer
+	if s := call(t, server, http.MethodGet, "/api/v1/peers", nil, &peers); s != http.StatusOK || len(peers) != 1 ||
+		peers[0].URL != "http://10.0.0.2:8080" || peers[0].Origin != "static" || !peers[0].Alive {
+		t.Errorf("Peers returned %v: %#v", s, peers)
+	}
+
+	if s := call(t, server, http.MethodDelete, "/api/v1/files/"+key, nil, nil); s != http.StatusNoContent {
+		t.Errorf("Withdrawing returned %v", s)
+	}
+	if s := call(t, server, http.MethodDelete, "/api/v1/files/"+key, nil, nil); s != http.StatusNotFound {
+		t.Errorf("Withdrawing again returned %v", s)
+	}
+}
@@ -0,0 +1,295 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command cafs controls a running CAFS service (see synctest) via its JSON API.
+//
+// Usage:
+//
+//	cafs [flags] jobs [list]
+//	cafs [flags] jobs start [-key key] [-source-token token] [-wait] source
+//	cafs [flags] jobs start -key key [-source-token token] [-wait]
+//	cafs [flags] jobs show id
+//	cafs [flags] jobs wait id
+//	cafs [flags] jobs cancel id
+//	cafs [flags] peers
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+var addr = "127.0.0.1:8080"
+var token string
+var client = http.DefaultClient
+var scheme = "http"
+
+// Struct job mirrors the sync jobs reported by the API.
+type job struct {
+	ID       string `json:"id"`
+	Source   string `json:"source"`
+	Status   string `json:"status"`
+	Key      string `json:"key"`
+	Error    string `json:"error"`
+	Progress struct {
+		BytesTotal       int64 `json:"bytesTotal"`
+		BytesReused      int64 `json:"bytesReused"`
+		BytesTransferred int64 `json:"bytesTransferred"`
+		BytesRequested   int64 `json:"bytesRequested"`
+	} `json:"progress"`
+}
+
+func (j *job) finished() bool {
+	return j.Status != "queued" && j.Status != "running"
+}
+
+func (j *job) progress() string {
+	p := j.Progress
+	if p.BytesTotal == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", 100*(p.BytesReused+p.BytesTransferred)/p.BytesTotal)
+}
+
+func main() {
+	flag.StringVar(&addr, "l", addr, "the service's address")
+	flag.StringVar(&token, "token", token, "bearer token to authenticate with")
+	useTLS, tlsCA, tlsCert, tlsKey := false, "", "", ""
+	flag.BoolVar(&useTLS, "tls", useTLS, "connects via TLS (implied by the other -tls flags)")
+	flag.StringVar(&tlsCA, "tls-ca", tlsCA, "verifies the service against these PEM CAs instead of the system's")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "PEM client certificate to present to the service")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "the PEM private key belonging to -tls-cert")
+	flag.Usage = usage
+	flag.Parse()
+
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		config, err := httpsync.LoadClientTLSConfig(tlsCA, tlsCert, tlsKey)
+		if err != nil {
+			fail(err)
+		}
+		client = httpsync.NewClient(config)
+		scheme = "https"
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+	var err error
+	switch args[0] {
+	case "jobs":
+		err = jobs(args[1:])
+	case "peers":
+		err = peers()
+	default:
+		usage()
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %v [flags] jobs [list]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %v [flags] jobs start [-key key] [-source-token token] [-wait] source\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %v [flags] jobs start -key key [-source-token token] [-wait]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %v [flags] jobs (show|wait|cancel) id\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %v [flags] peers\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	os.Exit(1)
+}
+
+func jobs(args []string) error {
+	if len(args) == 0 || args[0] == "list" {
+		var list []job
+		if err := call(http.MethodGet, "syncs", nil, &list); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tPROGRESS\tKEY\tSOURCE")
+		for _, j := range list {
+			key := j.Key
+			if len(key) > 16 {
+				key = key[:16]
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", j.ID, j.Status, j.progress(), key, j.Source)
+		}
+		return w.Flush()
+	}
+
+	switch args[0] {
+	case "start":
+		return startJob(args[1:])
+	case "show", "wait", "cancel":
+		if len(args) != 2 {
+			usage()
+		}
+		var j job
+		var err error
+		switch args[0] {
+		case "show":
+			err = call(http.MethodGet, "syncs/"+args[1], nil, &j)
+		case "wait":
+			j, err = waitForJob(args[1])
+		case "cancel":
+			err = call(http.MethodDelete, "syncs/"+args[1], nil, &j)
+		}
+		if err != nil {
+			return err
+		}
+		return printJob(j)
+	}
+	usage()
+	return nil
+}
+
+func startJob(args []string) error {
+	flags := flag.NewFlagSet("jobs start", flag.ExitOnError)
+	key := flags.String("key", "", "the key of the file expected")
+	sourceToken := flags.String("source-token", "", "bearer token to authenticate with at the source")
+	wait := flags.Bool("wait", false, "waits for the job to finish")
+	_ = flags.Parse(args)
+	// Without a source, the service asks its peers
+	if flags.NArg() > 1 || flags.NArg() == 0 && *key == "" {
+		usage()
+	}
+
+	req := map[string]string{}
+	if flags.NArg() == 1 {
+		req["source"] = flags.Arg(0)
+	}
+	if *key != "" {
+		req["key"] = *key
+	}
+	if *sourceToken != "" {
+		req["token"] = *sourceToken
+	}
+	var j job
+	if err := call(http.MethodPost, "syncs", req, &j); err != nil {
+		return err
+	}
+	if *wait {
+		var err error
+		if j, err = waitForJob(j.ID); err != nil {
+			return err
+		}
+	}
+	return printJob(j)
+}
+
+func peers() error {
+	var list []struct {
+		URL      string     `json:"url"`
+		Origin   string     `json:"origin"`
+		Alive    bool       `json:"alive"`
+		Capacity int64      `json:"capacity"`
+		Used     int64      `json:"used"`
+		LastSeen *time.Time `json:"lastSeen"`
+	}
+	if err := call(http.MethodGet, "peers", nil, &list); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tORIGIN\tALIVE\tUSED\tCAPACITY\tLAST SEEN")
+	for _, p := range list {
+		lastSeen := "-"
+		if p.LastSeen != nil {
+			lastSeen = time.Since(*p.LastSeen).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", p.URL, p.Origin, p.Alive, p.Used, p.Capacity, lastSeen)
+	}
+	return w.Flush()
+}
+
+// Polls the job until it has finished.
+func waitForJob(id string) (job, error) {
+	for {
+		var j job
+		if err := call(http.MethodGet, "syncs/"+id, nil, &j); err != nil || j.finished() {
+			return j, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func printJob(j job) error {
+	fmt.Printf("%v: %v (%v) %v\n", j.ID, j.Status, j.progress(), j.Source)
+	if j.Key != "" {
+		fmt.Printf("key: %v\n", j.Key)
+	}
+	if j.Error != "" {
+		fmt.Printf("error: %v\n", j.Error)
+	}
+	if j.finished() && j.Status != "succeeded" {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Calls the API and decodes the response into `result`.
+func call(method, path string, body interface{}, result interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s/api/v1/%s", scheme, addr, path), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("%v: %v", resp.Status, e.Error.Message)
+		}
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, result)
+}
@@ -0,0 +1,296 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// The number of finished jobs remembered.
+const maxFinishedJobs = 100
+
+var errNoSuchJob = errors.New("no such job")
+var errJobFinished = errors.New("job already finished")
+
+// Struct jobManager queues sync requests and runs a limited number of them at a time. A request for
+// a file that is already being synced, identified by its key or else by its source, joins the
+// existing job instead of starting another one. Requests without a source are served by the peers
+// holding the file. A jobManager is safe for concurrent use.
+type jobManager struct {
+	mutex    sync.Mutex
+	slots    chan struct{} // holds a token for every job running
+	nextID   int
+	jobs     map[string]*job // by ID
+	active   map[string]*job // unfinished jobs by what they sync
+	finished []*job          // finished jobs, oldest first
+}
+
+// Struct job is a sync managed by a jobManager.
+type job struct {
+	status apiSync // protected by the manager's mutex
+	what   string  // the key or, if unknown, the source
+	cancel context.CancelFunc
+	done   chan struct{} // closed when finished
+}
+
+var jobs = newJobManager(4)
+
+// Function SetMaxSyncs sets the number of syncs that may run at the same time, which must be
+// positive. Further syncs are queued. Must be called before Service.
+func SetMaxSyncs(n int) {
+	if n < 1 {
+		panic("the number of syncs must be positive")
+	}
+	jobs = newJobManager(n)
+}
+
+func newJobManager(maxRunning int) *jobManager {
+	return &jobManager{
+		slots:  make(chan struct{}, maxRunning),
+		jobs:   make(map[string]*job),
+		active: make(map[string]*job),
+	}
+}
+
+// Queues a sync, unless the same file is already being synced. Returns the job's status and whether
+// an existing job was joined.
+func (m *jobManager) submit(req apiSyncRequest) (apiSync, bool) {
+	what := req.Source
+	if req.Key != nil {
+		what = req.Key.String()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if j := m.active[what]; j != nil {
+		return j.status, true
+	}
+	m.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: apiSync{
+			ID:      strconv.Itoa(m.nextID),
+			Source:  req.Source,
+			Status:  jobQueued,
+			Created: time.Now(),
+			Key:     req.Key,
+		},
+		what:   what,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.jobs[j.status.ID] = j
+	m.active[what] = j
+	go m.run(ctx, j, req.Token)
+	return j.status, false
+}
+
+func (m *jobManager) run(ctx context.Context, j *job, token string) {
+	defer j.cancel()
+	select {
+	case m.slots <- struct{}{}:
+		defer func() { <-m.slots }()
+	case <-ctx.Done():
+		m.finish(j, nil, ctx.Err())
+		return
+	}
+
+	m.mutex.Lock()
+	now := time.Now()
+	j.status.Status, j.status.Started = jobRunning, &now
+	source, key := j.status.Source, j.status.Key
+	m.mutex.Unlock()
+
+	// Don't transfer what we already have
+	if key != nil {
+		if file, err := currentStorage().Get(key); err == nil {
+			m.finish(j, file, nil)
+			return
+		}
+	}
+
+	opts := httpsync.SyncOptions{
+		Metrics: syncMetrics,
+		Observer: remotesync.TransferObserverFunc(func(stats remotesync.TransferStats) {
+			m.mutex.Lock()
+			j.status.Progress = progressOf(stats)
+			m.mutex.Unlock()
+		}),
+	}
+	if source != "" {
+		// The token is meant for the source only
+		if token != "" {
+			opts.Header = http.Header{"Authorization": {"Bearer " + token}}
+		}
+		file, err := m.sync(ctx, j, source, key, opts)
+		m.finish(j, file, err)
+		return
+	}
+
+	// Try all peers holding the file, best first
+	holders := locate(ctx, *key)
+	if len(holders) == 0 {
+		m.finish(j, nil, fmt.Errorf("no peer has %v", key))
+		return
+	}
+	var errs []error
+	for _, holder := range holders {
+		opts.Header = peerHeader(holder.Peer)
+		file, err := m.sync(ctx, j, holder.URL, key, opts)
+		if err == nil || ctx.Err() != nil {
+			m.finish(j, file, err)
+			return
+		}
+		log.Printf("Job %v: syncing from %v failed: %v", j.status.ID, holder.Peer, err)
+		errs = append(errs, fmt.Errorf("%v: %w", holder.Peer, err))
+	}
+	m.finish(j, nil, errors.Join(errs...))
+}
+
+// Syncs the file from `source` and checks its key, if known.
+func (m *jobManager) sync(ctx context.Context, j *job, source string, key *cafs.SKey, opts httpsync.SyncOptions) (cafs.File, error) {
+	m.mutex.Lock()
+	j.status.Source = source
+	m.mutex.Unlock()
+
+	log.Printf("Job %v: syncing from %v", j.status.ID, source)
+	file, err := httpsync.SyncFromWithOptions(ctx, currentStorage(), client, source, "synced from "+source, opts)
+	if err == nil && key != nil && file.Key() != *key {
+		err = fmt.Errorf("received %v instead of %v", file.Key(), key)
+		file.Dispose()
+		file = nil
+	}
+	return file, err
+}
+
+// Records the outcome of a job. Disposes the file, if any.
+func (m *jobManager) finish(j *job, file cafs.File, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	j.status.Finished = &now
+	switch {
+	case err == nil:
+		key := file.Key()
+		file.Dispose()
+		j.status.Status, j.status.Key = jobSucceeded, &key
+		log.Printf("Job %v: received %v", j.status.ID, key)
+	case errors.Is(err, context.Canceled):
+		j.status.Status, j.status.Error = jobCanceled, err.Error()
+		log.Printf("Job %v: canceled", j.status.ID)
+	default:
+		j.status.Status, j.status.Error = jobFailed, err.Error()
+		log.Printf("Job %v: failed: %v", j.status.ID, err)
+	}
+	delete(m.active, j.what)
+	close(j.done)
+
+	m.finished = append(m.finished, j)
+	if len(m.finished) > maxFinishedJobs {
+		delete(m.jobs, m.finished[0].status.ID)
+		m.finished = m.finished[1:]
+	}
+}
+
+// Returns the number of jobs in the given state.
+func (m *jobManager) count(status string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n := 0
+	for _, j := range m.active {
+		if j.status.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *jobManager) get(id string) (apiSync, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	j := m.jobs[id]
+	if j == nil {
+		return apiSync{}, false
+	}
+	return j.status, true
+}
+
+// Returns all jobs known, oldest first.
+func (m *jobManager) list() []apiSync {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := make([]apiSync, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		result = append(result, j.status)
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].Created.Before(result[k].Created) })
+	return result
+}
+
+// Cancels a job that hasn't finished yet. Returns the job's status before it has been canceled.
+func (m *jobManager) cancel(id string) (apiSync, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	j := m.jobs[id]
+	if j == nil {
+		return apiSync{}, errNoSuchJob
+	}
+	if j.status.Finished != nil {
+		return j.status, errJobFinished
+	}
+	j.cancel()
+	return j.status, nil
+}
+
+// Blocks until the job has finished or `ctx` is done. Returns the job's status.
+func (m *jobManager) wait(ctx context.Context, id string) (apiSync, error) {
+	m.mutex.Lock()
+	j := m.jobs[id]
+	m.mutex.Unlock()
+	if j == nil {
+		return apiSync{}, errNoSuchJob
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return apiSync{}, ctx.Err()
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return j.status, nil
+}
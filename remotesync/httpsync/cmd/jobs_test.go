@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+// Returns a FileHandler serving random data of `size` bytes, and the file's key.
+func randomHandler(t *testing.T, seed int64, size int) (*httpsync.FileHandler, cafs.SKey) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	temp := ram.NewRamStorage(4 << 20).Create("random")
+	defer temp.Dispose()
+	_, _ = temp.Write(data)
+	if err := temp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := temp.File()
+	defer file.Dispose()
+	return httpsync.NewFileHandlerFromFile(file, nil), file.Key()
+}
+
+func TestJobManager(t *testing.T) {
+	setStorage(ram.NewRamStorage(8 << 20))
+	jobs = newJobManager(1)
+	defer SetMaxSyncs(4)
+
+	handlerA, keyA := randomHandler(t, 1, 100000)
+	defer handlerA.Dispose()
+	handlerB, keyB := randomHandler(t, 2, 100000)
+	defer handlerB.Dispose()
+
+	// A is served only after being released
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		handlerA.ServeHTTP(w, r)
+	}))
+	mux.Handle("/b", handlerB)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wait := func(id string) apiSync {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		job, err := jobs.wait(ctx, id)
+		if err != nil {
+			t.Fatalf("Error waiting for job %v: %v", id, err)
+		}
+		return job
+	}
+
+	a, joined := jobs.submit(apiSyncRequest{Source: server.URL + "/a", Key: &keyA})
+	if joined {
+		t.Error("First request joined a job")
+	}
+	// Requests for the same key join the job, even from another source
+	if again, joined := jobs.submit(apiSyncRequest{Source: server.URL + "/other", Key: &keyA}); !joined || again.ID != a.ID {
+		t.Errorf("Expected to join job %v, got %v (joined: %v)", a.ID, again.ID, joined)
+	}
+
+	// Only one job runs at a time, so B is queued and can be canceled
+	for job, _ := jobs.get(a.ID); job.Status == jobQueued; job, _ = jobs.get(a.ID) {
+		time.Sleep(time.Millisecond)
+	}
+	b, _ := jobs.submit(apiSyncRequest{Source: server.URL + "/b"})
+	time.Sleep(10 * time.Millisecond)
+	if job, _ := jobs.get(b.ID); job.Status != jobQueued {
+		t.Errorf("Expected B to be queued, got %v", job.Status)
+	}
+	if _, err := jobs.cancel(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job := wait(b.ID); job.Status != jobCanceled {
+		t.Errorf("Expected B to be canceled, got %#v", job)
+	}
+	if _, err := jobs.cancel(b.ID); err != errJobFinished {
+		t.Errorf("Expected errJobFinished, got %v", err)
+	}
+
+	close(release)
+	if job := wait(a.ID); job.Status != jobSucceeded || *job.Key != keyA || job.Progress.BytesTotal != 100000 {
+		t.Errorf("Unexpected result for A: %#v", job)
+	}
+
+	// Finished jobs aren't joined, and files received before aren't transferred again
+	again, joined := jobs.submit(apiSyncRequest{Source: server.URL + "/a", Key: &keyA})
+	if joined {
+		t.Error("Joined a finished job")
+	}
+	if job := wait(again.ID); job.Status != jobSucceeded || job.Progress.BytesTotal != 0 {
+		t.Errorf("Unexpected result for A synced again: %#v", job)
+	}
+
+	// Receiving an unexpected file fails
+	wrong, _ := jobs.submit(apiSyncRequest{Source: server.URL + "/b", Key: &cafs.SKey{1}})
+	if job := wait(wrong.ID); job.Status != jobFailed || job.Error == "" {
+		t.Errorf("Expected mismatching key to fail, got %#v", job)
+	}
+	// Whereas without a key, B is received
+	if b, _ = jobs.submit(apiSyncRequest{Source: server.URL + "/b"}); wait(b.ID).Key == nil || *wait(b.ID).Key != keyB {
+		t.Errorf("Unexpected result for B: %#v", wait(b.ID))
+	}
+
+	if list := jobs.list(); len(list) != 5 || list[0].ID != a.ID {
+		t.Errorf("Unexpected job list: %#v", list)
+	}
+}
+
+func TestSyncByKey(t *testing.T) {
+	setStorage(ram.NewRamStorage(8 << 20))
+	defer SetPeers(nil, "")
+
+	// The peer serves the random file by key
+	peerStorage := ram.NewRamStorage(4 << 20)
+	handler, key := randomHandler(t, 3, 100000)
+	defer handler.Dispose()
+	source := httptest.NewServer(handler)
+	file, err := httpsync.SyncFrom(context.Background(), peerStorage, http.DefaultClient, source.URL, "peer")
+	source.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Dispose()
+	gateway := httpsync.NewGateway(peerStorage, "/cafs/")
+	mux := http.NewServeMux()
+	mux.Handle("/cafs/", gateway)
+	mux.Handle(havePath, httpsync.NewHaveHandler(peerStorage, gateway))
+	// Remembers the credentials the peer receives
+	var authMutex sync.Mutex
+	var auths []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authMutex.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		authMutex.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	defer peer.Close()
+	empty := httptest.NewServer(http.NotFoundHandler())
+	defer empty.Close()
+
+	wait := func(id string) apiSync {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		job, err := jobs.wait(ctx, id)
+		if err != nil {
+			t.Fatalf("Error waiting for job %v: %v", id, err)
+		}
+		return job
+	}
+
+	// Without peers holding the file, the sync fails
+	SetPeers([]string{empty.URL}, "")
+	job, _ := jobs.submit(apiSyncRequest{Key: &key})
+	if job = wait(job.ID); job.Status != jobFailed {
+		t.Errorf("Expected sync to fail, got %#v", job)
+	}
+
+	// Peers receive the peer token, but never the token meant for a source
+	SetPeers([]string{empty.URL, strings.TrimPrefix(peer.URL, "http://")}, "peer-secret")
+	job, _ = jobs.submit(apiSyncRequest{Key: &key, Token: "secret"})
+	if job = wait(job.ID); job.Status != jobSucceeded || job.Source != peer.URL+gateway.PathOf(key) {
+		t.Errorf("Unexpected result: %#v", job)
+	}
+	if file, err := currentStorage().Get(&key); err != nil {
+		t.Errorf("File not in storage: %v", err)
+	} else {
+		file.Dispose()
+	}
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	if len(auths) < 3 {
+		t.Errorf("Expected /have, GET and POST requests, got %d", len(auths))
+	}
+	for _, auth := range auths {
+		if auth != "Bearer peer-secret" {
+			t.Errorf("Peer received unexpected credentials: %q", auth)
+		}
+	}
+}
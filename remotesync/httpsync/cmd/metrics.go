@@ -0,0 +1,63 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/metrics"
+)
+
+// Function metricsHandler returns the handler serving the service's metrics in the Prometheus text
+// format: the storage's usage, the sync jobs, and the transfers accounted for in syncMetrics. These
+// are the HTTP syncs served and started by this service; the service doesn't speak the session
+// protocol of cafs-sync.
+func metricsHandler() http.Handler {
+	// Resolve the storage per request, as it is replaced on reset
+	usage := func(f func(ui cafs.UsageInfo) int64) func() float64 {
+		return func() float64 {
+			if bounded, ok := currentStorage().(cafs.BoundedStorage); ok {
+				return float64(f(bounded.GetUsageInfo()))
+			}
+			return 0
+		}
+	}
+	jobsIn := func(status string) func() float64 {
+		return func() float64 { return float64(jobs.count(status)) }
+	}
+
+	r := metrics.NewRegistry()
+	r.Register(
+		metrics.NewGaugeFunc("cafs_storage_used_bytes", "Bytes used by the storage.",
+			usage(func(ui cafs.UsageInfo) int64 { return ui.Used })),
+		metrics.NewGaugeFunc("cafs_storage_capacity_bytes", "Bytes usable by the storage.",
+			usage(func(ui cafs.UsageInfo) int64 { return ui.Capacity })),
+		metrics.NewGaugeFunc("cafs_storage_locked_bytes", "Bytes locked, i.e. safe from eviction.",
+			usage(func(ui cafs.UsageInfo) int64 { return ui.Locked })),
+		metrics.NewGaugeFunc("cafs_storage_entries", "Entries (files and chunks) stored.",
+			usage(func(ui cafs.UsageInfo) int64 { return int64(ui.Entries) })),
+		metrics.NewCounterFunc("cafs_storage_evictions_total", "Entries removed to free space. Resets with the storage.",
+			usage(func(ui cafs.UsageInfo) int64 { return ui.Evictions })),
+		metrics.NewGaugeFunc("cafs_offered_files", "Files offered under /file/.",
+			func() float64 { return float64(len(registry.List())) }),
+		metrics.NewGaugeFunc("cafs_sync_jobs_queued", "Sync jobs waiting to run.", jobsIn(jobQueued)),
+		metrics.NewGaugeFunc("cafs_sync_jobs_running", "Sync jobs running.", jobsIn(jobRunning)),
+	)
+	r.Register(syncMetrics.Metrics()...)
+	return r
+}
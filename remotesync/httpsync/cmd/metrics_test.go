@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/indyjo/cafs/ram"
+)
+
+func TestMetrics(t *testing.T) {
+	setStorage(ram.NewRamStorage(8 << 20))
+	handler, key := randomHandler(t, 4, 100000)
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	job, _ := jobs.submit(apiSyncRequest{Source: server.URL, Key: &key})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if job, err := jobs.wait(ctx, job.ID); err != nil || job.Status != jobSucceeded {
+		t.Fatalf("Sync failed: %#v, %v", job, err)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	value := func(sample string) float64 {
+		m := regexp.MustCompile("(?m)^" + regexp.QuoteMeta(sample) + " (.*)$").FindStringSubmatch(body)
+		if m == nil {
+			t.Fatalf("Missing %v in:\n%v", sample, body)
+		}
+		v, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := value("cafs_storage_capacity_bytes"); v != 8<<20 {
+		t.Errorf("Unexpected capacity: %v", v)
+	}
+	if v := value("cafs_storage_entries"); v < 2 {
+		t.Errorf("Expected the file and its chunks to be stored, got %v entries", v)
+	}
+	if v := value(`cafs_sync_bytes_total{side="receive",kind="received"}`); v < 100000 {
+		t.Errorf("Expected at least 100000 bytes received, got %v", v)
+	}
+	if v := value(`cafs_sync_duration_seconds_count{side="receive"}`); v < 1 {
+		t.Errorf("Expected sync duration to be recorded, got %v", v)
+	}
+	value("cafs_storage_evictions_total")
+	value("cafs_sync_jobs_running")
+}
@@ -0,0 +1,157 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/httpsync"
+)
+
+// Peers are asked for files at this path, see httpsync.HaveHandler.
+const havePath = "/have"
+
+// How long peers may take to answer whether they have a file.
+const locateTimeout = 5 * time.Second
+
+var staticPeers []string
+var peerToken string
+var discovery *httpsync.Discovery
+
+// Function SetPeers sets the services asked for files requested by key only. Peers are given by
+// their base URL, e.g. "https://10.0.0.2:8080", or by their address if they speak plain HTTP. If
+// `token` is not empty, the service authenticates with it at these peers, and only at these. Tokens
+// given with sync requests are never sent to peers. Must be called before Service.
+func SetPeers(peers []string, token string) {
+	staticPeers, peerToken = nil, token
+	for _, peer := range peers {
+		if !strings.Contains(peer, "://") {
+			peer = "http://" + peer
+		}
+		staticPeers = append(staticPeers, strings.TrimSuffix(peer, "/"))
+	}
+}
+
+// Function SetDiscovery lets the service find peers on the local network, and announce itself to
+// them, by multicasting to `group` (e.g. httpsync.DefaultDiscoveryGroup) via the interface named
+// `iface`, or via the system's default if empty. Discovered peers are asked for files requested by
+// key, but unlike those set by SetPeers, they never receive credentials. Must be called before Service.
+func SetDiscovery(group string, iface string) error {
+	d, err := httpsync.NewDiscovery(group)
+	if err != nil {
+		return err
+	}
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return err
+		}
+		d.WithInterface(i)
+	}
+	discovery = d.WithPrinter(log.New(os.Stderr, "", log.LstdFlags))
+	return nil
+}
+
+// Announces the service listening on `addr` until `ctx` is done.
+func runDiscovery(ctx context.Context, addr string) {
+	// Peers fill in the host as seen from their side, unless it is given explicitly
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid address %v: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	url := scheme + "://" + net.JoinHostPort(host, port)
+
+	discovery.WithAnnouncement(func() httpsync.Announcement {
+		a := httpsync.Announcement{URL: url}
+		if bounded, ok := currentStorage().(cafs.BoundedStorage); ok {
+			ui := bounded.GetUsageInfo()
+			a.Capacity, a.Used = ui.Capacity, ui.Used
+		}
+		return a
+	})
+	if err := discovery.Run(ctx); err != nil {
+		log.Printf("Discovery disabled: %v", err)
+	}
+}
+
+// Returns the base URLs of the discovered peers that are alive and not set statically.
+func discoveredPeers() []string {
+	var result []string
+	if discovery == nil {
+		return result
+	}
+	for _, peer := range discovery.Peers() {
+		if peer.Alive && !contains(staticPeers, peer.URL) {
+			result = append(result, peer.URL)
+		}
+	}
+	return result
+}
+
+// Returns the headers sent to `peer`: the peer token for static peers, and nothing for others.
+func peerHeader(peer string) http.Header {
+	if !contains(staticPeers, peer) {
+		return nil
+	}
+	return staticPeerHeader()
+}
+
+func staticPeerHeader() http.Header {
+	if peerToken == "" {
+		return nil
+	}
+	return http.Header{"Authorization": {"Bearer " + peerToken}}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the peers holding the file identified by `key`, best first. Only static peers receive
+// credentials.
+func locate(ctx context.Context, key cafs.SKey) []httpsync.Holder {
+	ctx, cancel := context.WithTimeout(ctx, locateTimeout)
+	defer cancel()
+	discovered := make(chan []httpsync.Holder, 1)
+	go func() {
+		discovered <- httpsync.Locate(ctx, client, discoveredPeers(), havePath, key, nil)
+	}()
+	holders := httpsync.Locate(ctx, client, staticPeers, havePath, key, staticPeerHeader())
+	holders = append(holders, <-discovered...)
+	sort.SliceStable(holders, func(i, j int) bool { return holders[i].Latency < holders[j].Latency })
+	return holders
+}
@@ -17,49 +17,106 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/ram"
 	"github.com/indyjo/cafs/remotesync/httpsync"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
 )
 
+var storageMutex sync.Mutex // Guards storage, which is replaced on reset
 var storage cafs.FileStorage = ram.NewRamStorage(1 << 30)
-var fileHandlers = make(map[string]*httpsync.FileHandler)
+var syncMetrics = httpsync.NewMetrics()
+var registry = httpsync.NewRegistry("/file/").WithPrinter(log.New(os.Stderr, "", log.LstdFlags)).WithMetrics(syncMetrics)
 var dataDir = "./"
+var limiter ratelimit.Limiter
+var auth *httpsync.Auth
+var tlsConfig *tls.Config
+var client = http.DefaultClient
+
+// Function SetRateLimit limits the combined rate at which all served files are sent, in bytes
+// per second. Must be called before Service.
+func SetRateLimit(rate int64) {
+	limiter = ratelimit.NewBucket(rate, 64*1024)
+	registry.WithLimiter(limiter)
+}
+
+// Function SetAuth protects all endpoints using `a`. Reading files requires ActionRead, adding files
+// and accessing the data dir requires ActionWrite, and everything else requires ActionAdmin. Must be
+// called before Service.
+func SetAuth(a *httpsync.Auth) {
+	auth = a
+	registry.WithAuth(a)
+}
+
+// Function SetTLS makes the service accept TLS connections only, using `config`, e.g. as returned by
+// httpsync.LoadServerTLSConfig. Must be called before Service.
+func SetTLS(config *tls.Config) {
+	tlsConfig = config
+}
+
+// Function SetClient sets the HTTP client used for connecting to other services when syncing files,
+// e.g. one returned by httpsync.NewClient or httpsync.NewH2CClient. Must be called before Service.
+func SetClient(c *http.Client) {
+	client = c
+}
 
 func Service(addr string, dir string, preloads []string) {
 	dataDir = dir
 
 	for _, preload := range preloads {
-		if _, err := loadFile(preload); err != nil {
+		if _, err := loadFile(preload, 0); err != nil {
 			log.Fatalf("Error loading '[%v]: %v", preload, err)
 		}
 	}
 
-	http.HandleFunc("/load", handleLoad)
-	http.HandleFunc("/save", handleSave)
-	http.HandleFunc("/sync", handleSync)
-	http.HandleFunc("/upload", handleUpload)
-	http.HandleFunc("/download", handleDownload)
-	http.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
-		storage.DumpStatistics(cafs.NewWriterPrinter(w))
+	// Use a private mux instead of http.DefaultServeMux
+	mux := http.NewServeMux()
+
+	// All files in storage are reachable by key. Resolve the storage per request, as it is replaced on reset.
+	mux.HandleFunc("/cafs/", func(w http.ResponseWriter, r *http.Request) {
+		gateway().ServeHTTP(w, r)
+	})
+	// Peers ask here whether a file is in storage
+	mux.HandleFunc(havePath, func(w http.ResponseWriter, r *http.Request) {
+		httpsync.NewHaveHandler(currentStorage(), gateway()).WithAuth(auth).ServeHTTP(w, r)
 	})
-	http.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
-		storage = ram.NewRamStorage(1 << 30)
-		fileHandlers = make(map[string]*httpsync.FileHandler)
+	// Loaded files are offered under /file/, which also lists them
+	mux.Handle("/file/", registry)
+	mux.Handle(apiPrefix, apiHandler())
+	mux.Handle("/load", auth.Require(httpsync.ActionWrite, http.HandlerFunc(handleLoad)))
+	mux.Handle("/unload", auth.Require(httpsync.ActionAdmin, http.HandlerFunc(handleUnload)))
+	mux.Handle("/save", auth.Require(httpsync.ActionWrite, http.HandlerFunc(handleSave)))
+	mux.Handle("/sync", auth.Require(httpsync.ActionWrite, http.HandlerFunc(handleSync)))
+	mux.Handle("/upload", auth.Require(httpsync.ActionWrite, http.HandlerFunc(handleUpload)))
+	mux.Handle("/download", auth.Require(httpsync.ActionWrite, http.HandlerFunc(handleDownload)))
+	mux.Handle("/list", auth.Require(httpsync.ActionAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		currentStorage().DumpStatistics(cafs.NewWriterPrinter(w))
+	})))
+	mux.Handle("/metrics", auth.Require(httpsync.ActionAdmin, metricsHandler()))
+	mux.Handle("/reset", auth.Require(httpsync.ActionAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Withdraw all files before replacing the storage they are stored in
+		registry.Clear()
+		setStorage(ram.NewRamStorage(1 << 30))
 
 		log.Println("reset done")
 		_, _ = w.Write([]byte("reset done"))
-	})
-	http.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) {
+	})))
+	mux.Handle("/dump", auth.Require(httpsync.ActionAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		name := r.FormValue("name")
 		if len(name) == 0 {
 			name = "goroutine"
@@ -73,9 +130,22 @@ func Service(addr string, dir string, preloads []string) {
 		if err != nil {
 			log.Printf("Error in profile.WriteTo: %v\n", err)
 		}
-	})
+	})))
 
-	err := http.ListenAndServe(addr, nil)
+	if discovery != nil {
+		go runDiscovery(context.Background(), addr)
+	}
+
+	server := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConfig}
+	// Lets peers sync many files over a single connection
+	httpsync.EnableHTTP2(server)
+	var err error
+	if tlsConfig != nil {
+		// Certificates are taken from the TLS configuration
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Fatalf("Error in ListenAndServe: %v", err)
 	}
@@ -90,7 +160,11 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	name := path.Join(dataDir, handler.Filename)
+	name, err := clientPath(handler.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		fmt.Println(err)
@@ -109,7 +183,11 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fileName := r.URL.Query().Get("name")
-	name := path.Join(dataDir, fileName)
+	name, err := clientPath(fileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", fileName))
@@ -132,37 +210,103 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func loadFile(path string) (string, error) {
-	file, err := httpsync.LoadFile(storage, path)
+// Returns the storage files are currently stored in.
+func currentStorage() cafs.FileStorage {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	return storage
+}
+
+// Replaces the storage files are stored in.
+func setStorage(s cafs.FileStorage) {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+	storage = s
+}
+
+// Returns a Gateway serving the current storage under /cafs/.
+func gateway() *httpsync.Gateway {
+	return httpsync.NewGateway(currentStorage(), "/cafs/").WithLimiter(limiter).WithAuth(auth).WithMetrics(syncMetrics)
+}
+
+// Checks a server-side path given by a client, which must lie within the data dir after resolving
+// symbolic links. Relative paths are relative to the data dir. Returns the resolved path.
+func clientPath(p string) (string, error) {
+	dir, err := resolvePath(dataDir)
 	if err != nil {
 		return "", err
 	}
-	defer file.Dispose()
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	if resolved != dir && !strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v is outside of the data dir", p)
+	}
+	return resolved, nil
+}
 
-	_, ok := fileHandlers[file.Key().String()]
-	if !ok {
-		printer := log.New(os.Stderr, "", log.LstdFlags)
-		handler := httpsync.NewFileHandlerFromFile(file, rand.Perm(256)).WithPrinter(printer)
-		fileHandlers[file.Key().String()] = handler
+// Returns the absolute path of `p` with all symbolic links resolved. If `p` doesn't exist yet,
+// resolves its directory instead.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return resolved, err
+	}
+	// Dangling symbolic links might point anywhere
+	if _, err := os.Lstat(abs); err == nil {
+		return "", fmt.Errorf("path %v is a dangling link", p)
+	}
+	parent := filepath.Dir(abs)
+	if parent == abs {
+		return abs, nil
+	}
+	if parent, err = resolvePath(parent); err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(abs)), nil
+}
 
-		path = fmt.Sprintf("/file/%v", file.Key().String()[:16])
-		http.Handle(path, handler)
-		log.Printf("serving under %v", path)
-	} else {
-		log.Printf("serving exists %v", path)
+func loadFile(path string, ttl time.Duration) (string, error) {
+	file, err := httpsync.LoadFile(currentStorage(), path)
+	if err != nil {
+		return "", err
 	}
+	defer file.Dispose()
+
+	path = registry.Offer(file, ttl)
+	log.Printf("serving under %v and /cafs/%v", path, file.Key())
 
 	return file.Key().String(), nil
 }
 
+// Loads a file and offers it. An optional `ttl` parameter limits the duration of the offer.
 func handleLoad(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	path := r.FormValue("path")
+	path, err := clientPath(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var ttl time.Duration
+	if s := r.FormValue("ttl"); s != "" {
+		if ttl, err = time.ParseDuration(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	hash, err := loadFile(path)
+	hash, err := loadFile(path, ttl)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -170,15 +314,35 @@ func handleLoad(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(hash))
 }
 
+// Withdraws the offer of a file.
+func handleUnload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := cafs.ParseKey(r.FormValue("hash"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !registry.Withdraw(*key) {
+		http.NotFound(w, r)
+	}
+}
+
 func handleSave(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 	hash := r.FormValue("hash")
-	path := r.FormValue("path")
+	path, err := clientPath(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	err := httpsync.SaveFile(storage, hash, path)
+	err = httpsync.SaveFile(currentStorage(), hash, path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -190,8 +354,29 @@ func handleSync(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	source := r.FormValue("source")
-	if err := httpsync.SyncFile(storage, source); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The source may require authentication, too. Without a source, peers are asked for the hash.
+	req := apiSyncRequest{Source: r.FormValue("source"), Token: r.FormValue("token")}
+	if hash := r.FormValue("hash"); hash != "" {
+		var err error
+		if req.Key, err = cafs.ParseKey(hash); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if req.Source == "" {
+		http.Error(w, "either source or hash required", http.StatusBadRequest)
+		return
+	}
+
+	// Wait for the job to finish, so that the file can be saved right away. The job continues if the
+	// client disconnects.
+	job, _ := jobs.submit(req)
+	job, err := jobs.wait(r.Context(), job.ID)
+	if err != nil {
+		return
+	}
+	if job.Status != jobSucceeded {
+		http.Error(w, fmt.Sprintf("sync %v: %v", job.Status, job.Error), http.StatusInternalServerError)
+		return
 	}
+	_, _ = fmt.Fprintln(w, job.Key)
 }
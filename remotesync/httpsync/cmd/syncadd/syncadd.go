@@ -3,22 +3,42 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+
+	"github.com/indyjo/cafs/remotesync/httpsync"
 )
 
+var token string
+var client = http.DefaultClient
+var scheme = "http"
+
 func main() {
 	addr := "127.0.0.1:8080"
 	flag.StringVar(&addr, "l", addr, "which port to connect")
 
 	path := ""
 	flag.StringVar(&path, "p", path, "input file to load")
+	flag.StringVar(&token, "token", token, "bearer token to authenticate with")
+	useTLS, tlsCA, tlsCert, tlsKey := false, "", "", ""
+	flag.BoolVar(&useTLS, "tls", useTLS, "connects via TLS (implied by the other -tls flags)")
+	flag.StringVar(&tlsCA, "tls-ca", tlsCA, "verifies the service against these PEM CAs instead of the system's")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "PEM client certificate to present to the service")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "the PEM private key belonging to -tls-cert")
 	flag.Parse()
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		config, err := httpsync.LoadClientTLSConfig(tlsCA, tlsCert, tlsKey)
+		if err != nil {
+			panic(err)
+		}
+		client = httpsync.NewClient(config)
+		scheme = "https"
+	}
 
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/load", addr),
-		"application/x-www-form-urlencoded",
+	resp, err := post(
+		fmt.Sprintf("%s://%s/load", scheme, addr),
 		strings.NewReader(fmt.Sprintf("path=%s", path)),
 	)
 	if err != nil {
@@ -33,3 +53,16 @@ func main() {
 
 	fmt.Println(string(body))
 }
+
+// Sends a form to the service, authenticating with the bearer token if given.
+func post(url string, form io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, form)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
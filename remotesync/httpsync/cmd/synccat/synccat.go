@@ -3,54 +3,91 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+
+	"github.com/indyjo/cafs/remotesync/httpsync"
 )
 
+var token string
+var client = http.DefaultClient
+var scheme = "http"
+
 func main() {
 	addr := "127.0.0.1:8080"
 	flag.StringVar(&addr, "l", addr, "which port to connect")
 
-	source := "127.0.0.1:8080"
-	flag.StringVar(&source, "s", source, "which source to connect")
+	source := ""
+	flag.StringVar(&source, "s", source, "which source to connect (default: any of the service's peers)")
 
 	hash := ""
 	flag.StringVar(&hash, "h", hash, "hash file to sync")
 
 	path := ""
 	flag.StringVar(&path, "p", path, "the file to save")
+	flag.StringVar(&token, "token", token, "bearer token to authenticate with")
+	useTLS, tlsCA, tlsCert, tlsKey := false, "", "", ""
+	flag.BoolVar(&useTLS, "tls", useTLS, "connects via TLS (implied by the other -tls flags)")
+	flag.StringVar(&tlsCA, "tls-ca", tlsCA, "verifies the service against these PEM CAs instead of the system's")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "PEM client certificate to present to the service")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "the PEM private key belonging to -tls-cert")
+
+	sourceToken := ""
+	flag.StringVar(&sourceToken, "source-token", sourceToken, "bearer token to authenticate with at the source")
 	flag.Parse()
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		config, err := httpsync.LoadClientTLSConfig(tlsCA, tlsCert, tlsKey)
+		if err != nil {
+			panic(err)
+		}
+		client = httpsync.NewClient(config)
+		scheme = "https"
+	}
 
 	if addr != source {
-		sync(addr, source, hash)
+		sync(addr, source, hash, sourceToken)
 	}
 	save(addr, hash, path)
 }
 
-func sync(addr string, source string, hash string) {
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/sync", addr),
-		"application/x-www-form-urlencoded",
-		strings.NewReader(fmt.Sprintf("source=%s", fmt.Sprintf("http://%s/file/%s", source, hash[:16]))),
-	)
+func sync(addr string, source string, hash string, sourceToken string) {
+	// The source is assumed to use the same scheme as the service. Without a source, the service
+	// asks its peers.
+	form := url.Values{"hash": {hash}}
+	if source != "" {
+		form.Set("source", fmt.Sprintf("%s://%s/file/%s", scheme, source, hash[:16]))
+	} else {
+		source = "peers"
+	}
+	if sourceToken != "" {
+		form.Set("token", sourceToken)
+	}
+	resp, err := post(fmt.Sprintf("%s://%s/sync", scheme, addr), strings.NewReader(form.Encode()))
 	if err != nil {
 		panic(err)
 	}
 
 	defer resp.Body.Close()
-	_, err = ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		panic(err)
 	}
+	// Don't try to save what hasn't been received
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "sync %s from %s failed: %s", hash, source, body)
+		os.Exit(1)
+	}
 
 	fmt.Printf("sync %s from %s, done\n", hash, source)
 }
 
 func save(addr string, hash string, path string) {
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/save", addr),
-		"application/x-www-form-urlencoded",
+	resp, err := post(
+		fmt.Sprintf("%s://%s/save", scheme, addr),
 		strings.NewReader(fmt.Sprintf("hash=%s&path=%s", hash, path)),
 	)
 	if err != nil {
@@ -65,3 +102,16 @@ func save(addr string, hash string, path string) {
 
 	fmt.Printf("save %s to %s, done\n", hash, path)
 }
+
+// Sends a form to the service, authenticating with the bearer token if given.
+func post(url string, form io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, form)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
@@ -17,9 +17,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"log"
+	"os"
+	"strings"
 
 	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/httpsync"
 	"github.com/indyjo/cafs/remotesync/httpsync/cmd"
 )
 
@@ -36,8 +41,109 @@ func main() {
 	flag.BoolVar(&remotesync.LoggingEnabled, "enable-remotesync-logging", remotesync.LoggingEnabled,
 		"enables detailed logging from the remotesync algorithm")
 
+	rate := int64(0)
+	flag.Int64Var(&rate, "rate", rate, "limits the upload rate of all served files in KB/s (0: unlimited)")
+
+	token := ""
+	flag.StringVar(&token, "token", token, "requires clients to authenticate with this bearer token (grants all actions)")
+
+	urlSecret := ""
+	flag.StringVar(&urlSecret, "url-secret", urlSecret, "accepts URLs signed with this secret for reading single files")
+
+	anonymousRead := false
+	flag.BoolVar(&anonymousRead, "anonymous-read", anonymousRead, "lets unauthenticated clients read files if authentication is enabled")
+
+	tlsCert, tlsKey := "", ""
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "serves via TLS using this PEM certificate, which is also presented to peers")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "the PEM private key belonging to -tls-cert")
+
+	tlsClientCA := ""
+	flag.StringVar(&tlsClientCA, "tls-client-ca", tlsClientCA, "authenticates clients presenting a certificate issued by these PEM CAs (grants all actions)")
+
+	tlsCA := ""
+	flag.StringVar(&tlsCA, "tls-ca", tlsCA, "verifies peers against these PEM CAs instead of the system's when syncing")
+
+	maxSyncs := 4
+	flag.IntVar(&maxSyncs, "max-syncs", maxSyncs, "how many syncs may run at the same time")
+
+	h2c := false
+	flag.BoolVar(&h2c, "h2c", h2c, "speaks unencrypted HTTP/2 to peers when syncing from http:// URLs, falling back to HTTP/1.1")
+
+	peers := ""
+	flag.StringVar(&peers, "peers", peers, "comma-separated peers to ask for files requested by key only")
+	peerToken := ""
+	flag.StringVar(&peerToken, "peer-token", peerToken, "bearer token to authenticate with at the peers given by -peers")
+
+	discover, discoveryGroup, discoveryIface := false, httpsync.DefaultDiscoveryGroup, ""
+	flag.BoolVar(&discover, "discover", discover, "finds peers on the local network, and announces this service to them")
+	flag.StringVar(&discoveryGroup, "discovery-group", discoveryGroup, "the multicast group used by -discover")
+	flag.StringVar(&discoveryIface, "discovery-iface", discoveryIface, "the network interface used by -discover (default: the system's)")
+
 	flag.Parse()
 
+	if rate > 0 {
+		cmd.SetRateLimit(rate * 1024)
+	}
+	if maxSyncs < 1 {
+		log.Fatalf("-max-syncs must be at least 1, got %d", maxSyncs)
+	}
+	cmd.SetMaxSyncs(maxSyncs)
+	if peers != "" {
+		cmd.SetPeers(strings.Split(peers, ","), peerToken)
+	}
+	if discover {
+		if err := cmd.SetDiscovery(discoveryGroup, discoveryIface); err != nil {
+			log.Fatalf("Error setting up discovery: %v", err)
+		}
+	}
+
+	if tlsCert != "" || tlsKey != "" {
+		config, err := httpsync.LoadServerTLSConfig(tlsCert, tlsKey, tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.SetTLS(config)
+	} else if tlsClientCA != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	if tlsCA != "" || tlsCert != "" || h2c {
+		var config *tls.Config
+		if tlsCA != "" || tlsCert != "" {
+			var err error
+			if config, err = httpsync.LoadClientTLSConfig(tlsCA, tlsCert, tlsKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if h2c {
+			cmd.SetClient(httpsync.NewH2CClient(config))
+		} else {
+			cmd.SetClient(httpsync.NewClient(config))
+		}
+	}
+
+	if token != "" || urlSecret != "" || tlsClientCA != "" {
+		var authenticators []httpsync.Authenticator
+		// All identified clients are administrators
+		policy := httpsync.NewAccessList().
+			Grant(httpsync.Anyone, httpsync.ActionRead).
+			Grant(httpsync.Anyone, httpsync.ActionWrite).
+			Grant(httpsync.Anyone, httpsync.ActionAdmin)
+		if tlsClientCA != "" {
+			authenticators = append(authenticators, httpsync.ClientCertificates{})
+		}
+		if token != "" {
+			authenticators = append(authenticators, httpsync.BearerTokens{token: "admin"})
+		}
+		if urlSecret != "" {
+			authenticators = append(authenticators, httpsync.NewURLSigner([]byte(urlSecret)))
+		}
+		if anonymousRead {
+			policy.Grant(httpsync.Anonymous, httpsync.ActionRead)
+		}
+		auth := httpsync.NewAuth(httpsync.FirstOf(authenticators...), policy)
+		cmd.SetAuth(auth.WithPrinter(log.New(os.Stderr, "", log.LstdFlags)))
+	}
+
 	list := []string{}
 	if preload != "" {
 		list = append(list, preload)
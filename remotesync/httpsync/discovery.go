@@ -0,0 +1,340 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/indyjo/cafs"
+)
+
+// The multicast group nodes announce themselves to by default.
+const DefaultDiscoveryGroup = "239.255.67.65:7465"
+
+// Identifies announcements of this protocol version.
+const discoveryMagic = "cafs-discovery/1"
+
+// A peer is considered dead when this many announcements are missing, and it is forgotten when ten
+// times as many are missing.
+const missedAnnouncements = 3
+
+// Announced intervals are clamped to this range, so that peers can neither flood the table with
+// expiring entries nor stay alive forever.
+const (
+	minAnnouncementInterval = 10 * time.Millisecond
+	maxAnnouncementInterval = 5 * time.Minute
+)
+
+// The maximum number of peers in the table. Announcements of further peers are ignored.
+const maxDiscoveredPeers = 256
+
+// Struct Announcement is sent periodically by every node taking part in discovery.
+type Announcement struct {
+	ID       string        `json:"id"`       // Identifies the node, chosen randomly on start
+	URL      string        `json:"url"`      // The node's base URL; a missing host means the sender's address
+	Capacity int64         `json:"capacity"` // The node's storage capacity in bytes, if bounded
+	Used     int64         `json:"used"`     // The number of bytes in use
+	Interval time.Duration `json:"interval"` // The time until the next announcement, in nanoseconds
+	Leaving  bool          `json:"leaving,omitempty"`
+}
+
+// Struct Peer describes a node found by a Discovery.
+type Peer struct {
+	Announcement
+	Addr      string    // The address announcements are received from
+	FirstSeen time.Time // When the first announcement was received
+	LastSeen  time.Time // When the latest announcement was received
+	Alive     bool      // Whether announcements are received on time
+}
+
+// Struct Discovery finds other nodes on the local network and announces the local node to them,
+// using UDP multicast. Each node periodically sends an Announcement to a multicast group, and
+// maintains a table of the peers heard from. A Discovery is safe for concurrent use.
+//
+// Announcements are not authenticated. Anybody on the network can announce a peer, but only at the
+// address the announcement is sent from. Discovered peers must therefore not be trusted with
+// credentials, and files received from them must be checked against their keys.
+type Discovery struct {
+	group    *net.UDPAddr
+	iface    *net.Interface
+	interval time.Duration
+	id       string
+	announce func() Announcement
+	log      cafs.Printer
+
+	mutex sync.Mutex
+	peers map[string]*Peer // by ID
+}
+
+// Function NewDiscovery creates a Discovery using the multicast `group`, given as "host:port", e.g.
+// DefaultDiscoveryGroup. By default, announcements are sent every ten seconds via the system's default
+// multicast interface.
+func NewDiscovery(group string) (*Discovery, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("not a multicast address: %v", addr)
+	}
+	id := make([]byte, 8)
+	if _, err := cryptorand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Discovery{
+		group:    addr,
+		interval: 10 * time.Second,
+		id:       hex.EncodeToString(id),
+		log:      cafs.NewWriterPrinter(ioutil.Discard),
+		peers:    make(map[string]*Peer),
+	}, nil
+}
+
+// Sets the Discovery's log Printer.
+func (d *Discovery) WithPrinter(printer cafs.Printer) *Discovery {
+	d.log = printer
+	return d
+}
+
+// Sends and receives announcements via the given network interface, e.g. the loopback interface.
+func (d *Discovery) WithInterface(iface *net.Interface) *Discovery {
+	d.iface = iface
+	return d
+}
+
+// Sets the time between two announcements. Intervals outside of the range accepted from peers are
+// clamped to it.
+func (d *Discovery) WithInterval(interval time.Duration) *Discovery {
+	d.interval = clampInterval(interval)
+	return d
+}
+
+// Announces the local node, as described by the Announcement returned by `announce`, which is called
+// before each announcement. Its ID and Interval are filled in. Without an announcement, the
+// Discovery only listens.
+func (d *Discovery) WithAnnouncement(announce func() Announcement) *Discovery {
+	d.announce = announce
+	return d
+}
+
+// Returns the ID the local node announces itself with.
+func (d *Discovery) ID() string {
+	return d.id
+}
+
+// Receives and sends announcements until `ctx` is done. Then a last announcement tells
+// the peers that the local node is leaving. Returns an error if the network can't be used.
+func (d *Discovery) Run(ctx context.Context) error {
+	listener, err := net.ListenMulticastUDP("udp4", d.iface, d.group)
+	if err != nil {
+		return fmt.Errorf("error joining %v: %w", d.group, err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer listener.Close()
+
+	var sender *net.UDPConn
+	if d.announce != nil {
+		// Sending from the interface's address makes the system send via that interface
+		var local *net.UDPAddr
+		if d.iface != nil {
+			if local, err = ipv4Of(d.iface); err != nil {
+				return err
+			}
+		}
+		if sender, err = net.DialUDP("udp4", local, d.group); err != nil {
+			return fmt.Errorf("error sending to %v: %w", d.group, err)
+		}
+		//noinspection GoUnhandledErrorResult
+		defer sender.Close()
+	}
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		d.receive(listener)
+	}()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if sender != nil {
+			d.send(sender, false)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if sender != nil {
+				d.send(sender, true)
+			}
+			_ = listener.Close()
+			<-received
+			return nil
+		}
+	}
+}
+
+func ipv4Of(iface *net.Interface) (*net.UDPAddr, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipnet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %v has no IPv4 address", iface.Name)
+}
+
+func (d *Discovery) send(sender *net.UDPConn, leaving bool) {
+	a := d.announce()
+	a.ID, a.Interval, a.Leaving = d.id, d.interval, leaving
+	data, err := json.Marshal(struct {
+		Magic string `json:"magic"`
+		Announcement
+	}{discoveryMagic, a})
+	if err == nil {
+		_, err = sender.Write(data)
+	}
+	if err != nil {
+		d.log.Printf("Error announcing: %v", err)
+	}
+}
+
+// Reads announcements until the listener is closed.
+func (d *Discovery) receive(listener *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg struct {
+			Magic string `json:"magic"`
+			Announcement
+		}
+		if err := json.Unmarshal(buf[:n], &msg); err != nil || msg.Magic != discoveryMagic {
+			continue
+		}
+		if err := d.update(msg.Announcement, from, time.Now()); err != nil {
+			d.log.Printf("Ignoring announcement from %v: %v", from, err)
+		}
+	}
+}
+
+// Updates the peer table with an announcement received from `from`.
+func (d *Discovery) update(a Announcement, from *net.UDPAddr, now time.Time) error {
+	if a.ID == d.id || a.ID == "" {
+		return nil
+	}
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Port() == "" {
+		return fmt.Errorf("invalid URL: %v", a.URL)
+	}
+	// Peers can only announce themselves, not other hosts
+	if ip := net.ParseIP(u.Hostname()); u.Hostname() == "" || ip != nil && ip.IsUnspecified() {
+		u.Host = net.JoinHostPort(from.IP.String(), u.Port())
+	} else if ip == nil || !ip.Equal(from.IP) {
+		return fmt.Errorf("URL %v doesn't point to the sender", a.URL)
+	}
+	a.URL = u.Scheme + "://" + u.Host
+	if a.Interval <= 0 {
+		a.Interval = d.interval
+	}
+	a.Interval = clampInterval(a.Interval)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	peer := d.peers[a.ID]
+	if a.Leaving {
+		// Only the peer itself may announce its leaving
+		if peer != nil && peer.Addr != from.String() {
+			return fmt.Errorf("peer %v is at %v", a.ID, peer.Addr)
+		}
+		if peer != nil {
+			d.log.Printf("Peer %v at %v left", a.ID, peer.URL)
+			delete(d.peers, a.ID)
+		}
+		return nil
+	}
+	if peer == nil {
+		// A node restarted under the same URL replaces its predecessor
+		for id, other := range d.peers {
+			if other.URL == a.URL {
+				delete(d.peers, id)
+			}
+		}
+		d.prune(now)
+		if len(d.peers) >= maxDiscoveredPeers {
+			return fmt.Errorf("too many peers")
+		}
+		d.log.Printf("Discovered peer %v at %v", a.ID, a.URL)
+		peer = &Peer{FirstSeen: now}
+		d.peers[a.ID] = peer
+	}
+	peer.Announcement, peer.Addr, peer.LastSeen = a, from.String(), now
+	return nil
+}
+
+// Returns the peers currently known, ordered by URL, including those that have missed some
+// announcements. See Peer.Alive.
+func (d *Discovery) Peers() []Peer {
+	now := time.Now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.prune(now)
+	result := make([]Peer, 0, len(d.peers))
+	for _, peer := range d.peers {
+		p := *peer
+		p.Alive = now.Sub(peer.LastSeen) <= missedAnnouncements*peer.Interval
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].URL < result[j].URL })
+	return result
+}
+
+func clampInterval(interval time.Duration) time.Duration {
+	if interval < minAnnouncementInterval {
+		return minAnnouncementInterval
+	} else if interval > maxAnnouncementInterval {
+		return maxAnnouncementInterval
+	}
+	return interval
+}
+
+// Forgets the peers that have been silent for too long. Must be called with d.mutex held.
+func (d *Discovery) prune(now time.Time) {
+	for id, peer := range d.peers {
+		if now.Sub(peer.LastSeen) > 10*missedAnnouncements*peer.Interval {
+			d.log.Printf("Forgetting peer %v at %v", id, peer.URL)
+			delete(d.peers, id)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
+)
+
+// Struct Gateway implements the http.Handler interface and serves the files of a FileStorage by
+// their full key, i.e. under "<prefix><64 hex digits>". Any file contained in the storage is
+// reachable without registering it first.
+//
+// Requests carrying a remotesync handshake, as sent by SyncFrom, as well as POST requests are
+// answered using the sync protocol, exactly like a FileHandler would. All other GET and HEAD
+// requests receive the file's plain bytes. As file contents never change, the key serves as a
+// strong ETag, and byte ranges (including If-Range) are supported.
+type Gateway struct {
+	storage cafs.FileStorage
+	prefix  string
+	log     cafs.Printer
+	limiter ratelimit.Limiter
+	auth    *Auth
+	metrics *Metrics
+}
+
+// Function NewGateway creates a Gateway serving files from `storage`. The `prefix` is stripped from
+// request paths in order to obtain the key, e.g. "/cafs/".
+func NewGateway(storage cafs.FileStorage, prefix string) *Gateway {
+	return &Gateway{
+		storage: storage,
+		prefix:  prefix,
+		log:     cafs.NewWriterPrinter(ioutil.Discard),
+	}
+}
+
+// Sets the Gateway's log Printer.
+func (g *Gateway) WithPrinter(printer cafs.Printer) *Gateway {
+	g.log = printer
+	return g
+}
+
+// Limits the rate at which chunk data is sent using the sync protocol. Plain downloads are not limited.
+func (g *Gateway) WithLimiter(limiter ratelimit.Limiter) *Gateway {
+	g.limiter = limiter
+	return g
+}
+
+// Requires clients to be allowed to read the files requested, see ActionRead.
+func (g *Gateway) WithAuth(auth *Auth) *Gateway {
+	g.auth = auth
+	return g
+}
+
+// Accounts for all transfers using the sync protocol in `metrics`.
+func (g *Gateway) WithMetrics(metrics *Metrics) *Gateway {
+	g.metrics = metrics
+	return g
+}
+
+// Returns the path under which the Gateway serves the file identified by `key`.
+func (g *Gateway) PathOf(key cafs.SKey) string {
+	return g.prefix + key.String()
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, g.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := cafs.ParseKey(strings.TrimPrefix(r.URL.Path, g.prefix))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid key: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Check before looking up the file, so that its existence isn't revealed
+	var ok bool
+	if r, ok = g.auth.Check(w, r, ActionRead, key); !ok {
+		return
+	}
+
+	file, err := g.storage.Get(key)
+	if err == cafs.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		g.log.Printf("Error getting %v: %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Dispose()
+
+	// Responses depend on whether the client speaks the sync protocol
+	w.Header().Add("Vary", HeaderVersion)
+	if r.Method == http.MethodPost || r.Header.Get(HeaderVersion) != "" {
+		// Access has been checked already
+		handler := NewFileHandlerFromFile(file, nil).WithPrinter(g.log).WithLimiter(g.limiter).WithMetrics(g.metrics)
+		defer handler.Dispose()
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	content := newFileReadSeeker(file)
+	defer content.Close()
+	w.Header().Set("ETag", fmt.Sprintf(`"%v"`, key))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	// Handles Range, If-Range, If-None-Match and HEAD
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// Struct fileReadSeeker implements io.ReadSeeker on a cafs.File. Seeking is cheap: Reading after a
+// seek skips all chunks preceding the new position using their sizes and opens the chunk containing it.
+type fileReadSeeker struct {
+	file   cafs.File
+	offset int64 // the position as set by Seek and advanced by Read
+
+	iter  cafs.FileIterator // iterates the chunks following `chunk`, or nil
+	chunk cafs.File         // the chunk (or unchunked file) currently being read, or nil
+	r     io.ReadCloser     // reads from `chunk`, or nil
+	pos   int64             // the position `r` reads from
+}
+
+func newFileReadSeeker(file cafs.File) *fileReadSeeker {
+	return &fileReadSeeker{file: file}
+}
+
+func (s *fileReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.file.Size()
+	case io.SeekStart:
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *fileReadSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.file.Size() {
+		return 0, io.EOF
+	}
+	if s.r == nil || s.pos != s.offset {
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		n, err := s.r.Read(p)
+		s.pos += int64(n)
+		s.offset = s.pos
+		if err == io.EOF {
+			if n > 0 {
+				return n, nil
+			}
+			if s.nextChunk() {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// Positions the reader at `s.offset`.
+func (s *fileReadSeeker) open() error {
+	s.release()
+	var start int64
+	if s.file.IsChunked() {
+		s.iter = s.file.Chunks()
+		for {
+			if !s.iter.Next() {
+				return io.ErrUnexpectedEOF
+			}
+			if start+s.iter.Size() > s.offset {
+				break
+			}
+			start += s.iter.Size()
+		}
+		s.chunk = s.iter.File()
+	} else {
+		s.chunk = s.file.Duplicate()
+	}
+	s.r = s.chunk.Open()
+	s.pos = start
+	if _, err := io.CopyN(ioutil.Discard, s.r, s.offset-start); err != nil {
+		return err
+	}
+	s.pos = s.offset
+	return nil
+}
+
+// Continues reading with the next chunk, if any.
+func (s *fileReadSeeker) nextChunk() bool {
+	if s.iter == nil || !s.iter.Next() {
+		return false
+	}
+	_ = s.r.Close()
+	s.chunk.Dispose()
+	s.chunk = s.iter.File()
+	s.r = s.chunk.Open()
+	return true
+}
+
+func (s *fileReadSeeker) release() {
+	if s.r != nil {
+		_ = s.r.Close()
+		s.r = nil
+	}
+	if s.chunk != nil {
+		s.chunk.Dispose()
+		s.chunk = nil
+	}
+	if s.iter != nil {
+		s.iter.Dispose()
+		s.iter = nil
+	}
+}
+
+// Releases all resources. Doesn't dispose the file.
+func (s *fileReadSeeker) Close() error {
+	s.release()
+	return nil
+}
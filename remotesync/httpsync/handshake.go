@@ -0,0 +1,87 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/indyjo/cafs/remotesync"
+)
+
+// HTTP headers used for transmitting a remotesync.Handshake. Both requests and responses carry them.
+const (
+	HeaderVersion    = "X-Cafs-Sync-Version"
+	HeaderMinVersion = "X-Cafs-Sync-Min-Version"
+	HeaderHash       = "X-Cafs-Sync-Hash"
+	HeaderChunker    = "X-Cafs-Sync-Chunker"
+	HeaderFeatures   = "X-Cafs-Sync-Features"
+)
+
+// Function writeHandshake encodes a handshake into HTTP headers.
+func writeHandshake(h http.Header, hs remotesync.Handshake) {
+	h.Set(HeaderVersion, strconv.Itoa(hs.Version))
+	h.Set(HeaderMinVersion, strconv.Itoa(hs.MinVersion))
+	h.Set(HeaderHash, hs.Hash)
+	h.Set(HeaderChunker, hs.Chunker)
+	features := make([]string, len(hs.Features))
+	for i, f := range hs.Features {
+		features[i] = string(f)
+	}
+	h.Set(HeaderFeatures, strings.Join(features, ","))
+}
+
+// Function readHandshake decodes a handshake from HTTP headers. If no handshake is contained,
+// the peer is assumed to speak the legacy protocol.
+func readHandshake(h http.Header) (remotesync.Handshake, error) {
+	if h.Get(HeaderVersion) == "" {
+		return remotesync.LegacyHandshake(), nil
+	}
+
+	var hs remotesync.Handshake
+	if v, err := strconv.Atoi(h.Get(HeaderVersion)); err != nil {
+		return hs, fmt.Errorf("invalid %v header: %v", HeaderVersion, err)
+	} else {
+		hs.Version = v
+	}
+	if s := h.Get(HeaderMinVersion); s == "" {
+		hs.MinVersion = hs.Version
+	} else if v, err := strconv.Atoi(s); err != nil {
+		return hs, fmt.Errorf("invalid %v header: %v", HeaderMinVersion, err)
+	} else {
+		hs.MinVersion = v
+	}
+	hs.Hash = h.Get(HeaderHash)
+	hs.Chunker = h.Get(HeaderChunker)
+	for _, f := range strings.Split(h.Get(HeaderFeatures), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			hs.Features = append(hs.Features, remotesync.Feature(f))
+		}
+	}
+	return hs, nil
+}
+
+// Function negotiate reads the peer's handshake from HTTP headers and negotiates a common protocol.
+func negotiate(h http.Header) (remotesync.Handshake, error) {
+	remote, err := readHandshake(h)
+	if err != nil {
+		return remotesync.Handshake{}, err
+	}
+	return remotesync.Negotiate(remotesync.LocalHandshake(), remote)
+}
@@ -0,0 +1,160 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indyjo/cafs"
+)
+
+// Struct Have is the answer of a HaveHandler to a peer asking for a file it holds.
+type Have struct {
+	Key  cafs.SKey
+	Size int64
+	Path string // The path under which the file can be synced, relative to the peer's base URL
+}
+
+// Struct HaveHandler implements the http.Handler interface and answers GET requests of the form
+// "?key=<key>" with a Have if the file is contained in the storage, and with 404 otherwise. Files
+// are assumed to be served by a Gateway.
+type HaveHandler struct {
+	storage cafs.FileStorage
+	gateway *Gateway
+	auth    *Auth
+}
+
+// Function NewHaveHandler creates a HaveHandler answering for the files in `storage`, which are
+// served by `gateway`.
+func NewHaveHandler(storage cafs.FileStorage, gateway *Gateway) *HaveHandler {
+	return &HaveHandler{storage: storage, gateway: gateway}
+}
+
+// Requires clients to be allowed to read the file asked for, see ActionRead.
+func (h *HaveHandler) WithAuth(auth *Auth) *HaveHandler {
+	h.auth = auth
+	return h
+}
+
+func (h *HaveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := cafs.ParseKey(r.URL.Query().Get("key"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid key: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.auth.Check(w, r, ActionRead, key); !ok {
+		return
+	}
+	file, err := h.storage.Get(key)
+	if err == cafs.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size := file.Size()
+	file.Dispose()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(Have{Key: *key, Size: size, Path: h.gateway.PathOf(*key)})
+}
+
+// Struct Holder describes a peer holding a file, as found by Locate.
+type Holder struct {
+	Peer    string        // The peer's base URL
+	URL     string        // The URL to sync the file from
+	Size    int64         // The file's size
+	Latency time.Duration // How long the peer took to answer
+}
+
+// Function Locate asks all `peers`, given by their base URLs (e.g. "http://10.0.0.2:8080"),
+// concurrently whether they hold the file identified by `key`, using the endpoint at `havePath`
+// (e.g. "/have") served by a HaveHandler. Returns the holders, fastest first. Peers that don't answer
+// before `ctx` is done are ignored, as are peers failing to answer. Headers in `header` are sent
+// with each request, e.g. for authentication.
+func Locate(ctx context.Context, client *http.Client, peers []string, havePath string, key cafs.SKey, header http.Header) []Holder {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	holders := make([]Holder, 0, len(peers))
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if holder, err := ask(ctx, client, peer, havePath, key, header); err == nil {
+				mutex.Lock()
+				holders = append(holders, holder)
+				mutex.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+	sort.Slice(holders, func(i, j int) bool { return holders[i].Latency < holders[j].Latency })
+	return holders
+}
+
+func ask(ctx context.Context, client *http.Client, peer, havePath string, key cafs.SKey, header http.Header) (Holder, error) {
+	base := strings.TrimSuffix(peer, "/")
+	req, err := http.NewRequest(http.MethodGet, base+havePath+"?key="+url.QueryEscape(key.String()), nil)
+	if err != nil {
+		return Holder{}, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Holder{}, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = ioutil.ReadAll(resp.Body)
+		return Holder{}, fmt.Errorf("GET returned status %v", resp.Status)
+	}
+	var have Have
+	if err := json.NewDecoder(resp.Body).Decode(&have); err != nil {
+		return Holder{}, err
+	}
+	if have.Key != key {
+		return Holder{}, fmt.Errorf("peer answered for %v instead of %v", have.Key, key)
+	}
+	// Files must be synced from the peer itself
+	if !strings.HasPrefix(have.Path, "/") || strings.HasPrefix(have.Path, "//") {
+		return Holder{}, fmt.Errorf("invalid path: %v", have.Path)
+	}
+	return Holder{
+		Peer:    peer,
+		URL:     base + have.Path,
+		Size:    have.Size,
+		Latency: time.Since(start),
+	}, nil
+}
@@ -26,13 +26,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"sync"
-	"time"
 
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 )
 
@@ -44,6 +45,42 @@ type FileHandler struct {
 	source   chunksSource
 	syncinfo *remotesync.SyncInfo
 	log      cafs.Printer
+	limiter  ratelimit.Limiter
+	auth     *Auth
+	metrics  *Metrics
+	// The highest priority unauthenticated clients and signed URLs may request
+	maxPriority ratelimit.Priority
+}
+
+// HTTP header used by the receiver to request a transfer priority from the sender. Senders grant
+// priorities above their default maximum to authenticated clients only, see FileHandler.WithMaxPriority.
+const HeaderPriority = "X-Cafs-Sync-Priority"
+
+// Struct SyncOptions contains optional settings for SyncFromWithOptions. The zero value
+// contains the settings used by SyncFrom.
+type SyncOptions struct {
+	// If not nil, limits the rate at which chunk data is received.
+	Limiter ratelimit.Limiter
+	// The priority of the transfer, which is also requested from the sender.
+	Priority ratelimit.Priority
+	// If not nil, notified about the progress of the transfer.
+	Observer remotesync.TransferObserver
+	// If not nil, the receiver's worst-case footprint of locked bytes is reserved from this budget.
+	MemoryBudget *remotesync.MemoryBudget
+	// Whether the receiver may shrink its window in order to fit into the available memory.
+	AdaptiveWindow bool
+	// Additional headers sent with each request, e.g. for authentication.
+	Header http.Header
+	// If not nil, accounts for the transfer once it has ended.
+	Metrics *Metrics
+}
+
+func (opts *SyncOptions) writeHeader(h http.Header) {
+	for name, values := range opts.Header {
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
 }
 
 // It is the owner's responsibility to correctly dispose of FileHandler instances.
@@ -59,13 +96,24 @@ func (handler *FileHandler) Dispose() {
 }
 
 // Function NewFileHandlerFromFile creates a FileHandler that serves chunks of a File.
+// If `perm` is nil, a permutation is chosen based on the file's size and key, so that
+// all peers serving the same file use the same permutation.
 func NewFileHandlerFromFile(file cafs.File, perm shuffle.Permutation) *FileHandler {
 	result := &FileHandler{
 		m:        sync.Mutex{},
-		source:   fileBasedChunksSource{file: file.Duplicate()},
+		source:   &fileBasedChunksSource{file: file.Duplicate()},
 		syncinfo: &remotesync.SyncInfo{Perm: perm},
 		log:      cafs.NewWriterPrinter(ioutil.Discard),
 	}
+	if perm == nil {
+		// Peers supporting seeded permutations receive only the Spec
+		spec := shuffle.SpecForSize(file.Size(), shuffle.SeedFromKey(file.Key()))
+		if err := result.syncinfo.SetPermutationSpec(spec); err != nil {
+			// Not expected for specs chosen by SpecForSize. Fall back to a random permutation, as
+			// used by legacy senders.
+			result.syncinfo.Perm = rand.Perm(shuffle.MaxSize)
+		}
+	}
 	result.syncinfo.SetChunksFromFile(file)
 	return result
 }
@@ -93,27 +141,89 @@ func (handler *FileHandler) WithPrinter(printer cafs.Printer) *FileHandler {
 	return handler
 }
 
+// Limits the rate at which chunk data is sent by this FileHandler. Passing the same Limiter to
+// several FileHandlers limits their combined rate. Transfers are prioritized as requested by
+// the receiver.
+func (handler *FileHandler) WithLimiter(limiter ratelimit.Limiter) *FileHandler {
+	handler.limiter = limiter
+	return handler
+}
+
+// Requires clients to be allowed to read the file served, see ActionRead. Requests are checked
+// against the file key if known.
+func (handler *FileHandler) WithAuth(auth *Auth) *FileHandler {
+	handler.auth = auth
+	return handler
+}
+
+// Sets the highest priority granted to clients that haven't authenticated or that use a signed URL.
+// Clients requesting more are served at this priority. Defaults to ratelimit.Normal.
+func (handler *FileHandler) WithMaxPriority(p ratelimit.Priority) *FileHandler {
+	handler.maxPriority = p
+	return handler
+}
+
+// Accounts for all transfers in `metrics`.
+func (handler *FileHandler) WithMetrics(metrics *Metrics) *FileHandler {
+	handler.metrics = metrics
+	return handler
+}
+
 func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Always announce our own handshake, so that peers can tell why they were rejected.
+	writeHandshake(w.Header(), remotesync.LocalHandshake())
+
+	// The handler may be disposed concurrently
+	handler.m.Lock()
+	syncinfo, source := handler.syncinfo, handler.source
+	handler.m.Unlock()
+	if syncinfo == nil || source == nil {
+		http.Error(w, "file no longer served", http.StatusGone)
+		return
+	}
+
+	var ok bool
+	if r, ok = handler.auth.Check(w, r, ActionRead, syncinfo.Key); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	proto, err := negotiate(r.Header)
+	if err != nil {
+		handler.log.Printf("Handshake failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if r.Method == http.MethodGet {
-		if err := json.NewEncoder(w).Encode(handler.syncinfo); err != nil {
+		if proto.Supports(remotesync.FeatureSeededPermutation) {
+			syncinfo = syncinfo.Compact()
+		}
+		if err := json.NewEncoder(w).Encode(syncinfo); err != nil {
 			handler.log.Printf("Error serving SyncInfo: R%v", err)
 		}
 		return
-	} else if r.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
 	}
 
-	// Require a Connection: close header that will trick Go's HTTP server into allowing bi-directional streams.
-	if r.Header.Get("Connection") != "close" {
+	// HTTP/2 streams are full-duplex. With HTTP/1.1, require a Connection: close header that will trick
+	// Go's HTTP server into allowing bi-directional streams.
+	if r.ProtoMajor < 2 && r.Header.Get("Connection") != "close" {
 		http.Error(w, "Connection: close required", http.StatusBadRequest)
 		return
 	}
 
-	chunks, err := handler.source.GetChunks()
+	chunks, err := source.GetChunks()
 	if err != nil {
 		handler.log.Printf("GetChunks() failed: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if errors.Is(err, remotesync.ErrDisposed) {
+			status = http.StatusGone
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
 	defer chunks.Dispose()
@@ -121,19 +231,33 @@ func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
 
-	var bytesSkipped, bytesTransferred int64
-	cb := func(toTransfer, transferred int64) {
-		bytesSkipped = -toTransfer
-		bytesTransferred = transferred
-	}
+	var stats remotesync.TransferStats
 	handler.log.Printf("Calling WriteChunkData")
-	start := time.Now()
-	err = remotesync.WriteChunkData(chunks, 0, bufio.NewReader(r.Body), handler.syncinfo.Perm,
-		remotesync.SimpleFlushWriter{w, w.(http.Flusher)}, cb)
-	duration := time.Since(start)
-	speed := float64(bytesTransferred) / duration.Seconds()
-	handler.log.Printf("WriteChunkData took %v. KBytes transferred: %v (%.2f/s) skipped: %v",
-		duration, bytesTransferred>>10, speed/1024, bytesSkipped>>10)
+	sender := remotesync.Sender{
+		Encoding:  proto.WishlistEncoding(),
+		Limiter:   handler.limiter,
+		Context:   r.Context(),
+		Observer:  remotesync.TransferObserverFunc(func(s remotesync.TransferStats) { stats = s }),
+		ReadAhead: remotesync.DefaultReadAhead,
+	}
+	if p := r.Header.Get(HeaderPriority); p != "" {
+		if sender.Priority, err = ratelimit.ParsePriority(p); err != nil {
+			handler.log.Printf("Ignoring priority: %v", err)
+		}
+	}
+	// Signed URLs may be shared with anybody, so they don't grant higher priorities either
+	if id := IdentityFromContext(r.Context()); sender.Priority > handler.maxPriority && (id == nil || id.Key != nil) {
+		handler.log.Printf("Limiting priority %v of %v to %v", sender.Priority, id, handler.maxPriority)
+		sender.Priority = handler.maxPriority
+	}
+	var size int64
+	for _, ci := range syncinfo.Chunks {
+		size += int64(ci.Size)
+	}
+	err = sender.WriteChunkData(chunks, size, bufio.NewReader(r.Body), syncinfo.Perm,
+		remotesync.SimpleFlushWriter{W: w, F: w.(http.Flusher)}, nil)
+	handler.log.Printf("WriteChunkData finished: %v", stats)
+	handler.metrics.sent(stats, err)
 	if err != nil {
 		handler.log.Printf("Error in WriteChunkData: %v", err)
 		return
@@ -141,16 +265,39 @@ func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // Function SyncFrom uses an HTTP client to connect to some URL and download a fie into the
-// given FileStorage.
+// given FileStorage. Both peers exchange handshakes and agree on a common protocol version
+// first. If there is none, a *remotesync.IncompatibleError is returned.
 func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string) (file cafs.File, err error) {
+	return SyncFromWithOptions(ctx, storage, client, url, info, SyncOptions{})
+}
+
+// Function SyncFromWithOptions works like SyncFrom, but accepts additional settings.
+func SyncFromWithOptions(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string, opts SyncOptions) (file cafs.File, err error) {
 	// Fetch SyncInfo from remote
-	resp, err := client.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return
 	}
+	opts.writeHeader(req.Header)
+	writeHandshake(req.Header, remotesync.LocalHandshake())
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	// Peers not sending a handshake are assumed to speak the legacy protocol.
+	proto, negotiationErr := negotiate(resp.Header)
 	if resp.StatusCode != http.StatusOK {
+		if negotiationErr != nil {
+			return nil, negotiationErr
+		}
 		return nil, fmt.Errorf("GET returned status %v", resp.Status)
+	} else if negotiationErr != nil {
+		return nil, negotiationErr
 	}
+
 	var syncinfo remotesync.SyncInfo
 	err = json.NewDecoder(resp.Body).Decode(&syncinfo)
 	if err != nil {
@@ -158,11 +305,42 @@ func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client
 	}
 
 	// Create Builder and establish a bidirectional POST connection
-	builder := remotesync.NewBuilder(storage, &syncinfo, 32, info)
+	// The wishlist might still be written when the metrics are updated
+	var statsMutex sync.Mutex
+	var stats remotesync.TransferStats
+	observer := opts.Observer
+	if opts.Metrics != nil {
+		observer = remotesync.TransferObserverFunc(func(s remotesync.TransferStats) {
+			statsMutex.Lock()
+			stats = s
+			statsMutex.Unlock()
+			if opts.Observer != nil {
+				opts.Observer.TransferProgress(s)
+			}
+		})
+	}
+	builder := remotesync.NewBuilder(storage, &syncinfo, 32, info).
+		WithWishlistEncoding(proto.WishlistEncoding()).
+		WithLimiter(opts.Limiter, opts.Priority).
+		WithContext(ctx).
+		WithObserver(observer).
+		WithMemoryBudget(opts.MemoryBudget, opts.AdaptiveWindow)
 	defer builder.Dispose()
+	if opts.Metrics != nil {
+		defer func() {
+			statsMutex.Lock()
+			defer statsMutex.Unlock()
+			opts.Metrics.received(stats, err)
+		}()
+	}
+
+	// Fail early if the file can't be received without exceeding the available memory
+	if err = builder.Reserve(); err != nil {
+		return
+	}
 
 	pr, pw := io.Pipe()
-	req, err := http.NewRequest(http.MethodPost, url, pr)
+	req, err = http.NewRequest(http.MethodPost, url, pr)
 	if err != nil {
 		return
 	}
@@ -170,11 +348,20 @@ func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client
 	// Enable cancelation
 	req = req.WithContext(ctx)
 
-	// Trick Go's HTTP server implementation into allowing bi-directional data flow
-	req.Header.Set("Connection", "close")
+	// The POST request uses the same connection as the GET request. HTTP/2 streams are full-duplex and
+	// leave the connection open for further syncs. With HTTP/1.1, trick Go's HTTP server implementation
+	// into allowing bi-directional data flow.
+	if resp.ProtoMajor < 2 {
+		req.Header.Set("Connection", "close")
+	}
+
+	opts.writeHeader(req.Header)
+	// Tell the server which protocol we agreed on. Legacy servers simply ignore this.
+	writeHandshake(req.Header, proto)
+	req.Header.Set(HeaderPriority, opts.Priority.String())
 
 	go func() {
-		if err := builder.WriteWishList(remotesync.NopFlushWriter{pw}); err != nil {
+		if err := builder.WriteWishList(remotesync.NopFlushWriter{W: pw}); err != nil {
 			_ = pw.CloseWithError(fmt.Errorf("error in WriteWishList: %v", err))
 			return
 		}
@@ -185,16 +372,30 @@ func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client
 	if err != nil {
 		return
 	}
+	//noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST returned status %v", res.Status)
+	}
 	file, err = builder.ReconstructFileFromRequestedChunks(res.Body)
 	return
 }
 
 func SyncFile(fileStorage cafs.FileStorage, source string) error {
+	return SyncFileWithOptions(fileStorage, http.DefaultClient, source, SyncOptions{})
+}
+
+// Function SyncFileWithOptions works like SyncFile, but uses the given HTTP client, e.g. one created
+// by NewClient for connecting via TLS, and accepts additional settings. The Observer is replaced for
+// logging the transfer's statistics.
+func SyncFileWithOptions(fileStorage cafs.FileStorage, client *http.Client, source string, opts SyncOptions) error {
 	log.Printf("Sync from %v", source)
-	if file, err := SyncFrom(context.Background(), fileStorage, http.DefaultClient, source, "synced from "+source); err != nil {
+	var stats remotesync.TransferStats
+	opts.Observer = remotesync.TransferObserverFunc(func(s remotesync.TransferStats) { stats = s })
+	if file, err := SyncFromWithOptions(context.Background(), fileStorage, client, source, "synced from "+source, opts); err != nil {
 		return err
 	} else {
-		log.Printf("Successfully received %v (%v bytes)", file.Key(), file.Size())
+		log.Printf("Successfully received %v (%v bytes): %v", file.Key(), file.Size(), stats)
 		file.Dispose()
 	}
 	return nil
@@ -245,7 +446,7 @@ func LoadFile(storage cafs.FileStorage, path string) (cafs.File, error) {
 	defer tmp.Dispose()
 	n, err := io.Copy(tmp, f)
 	if err != nil {
-		return nil, fmt.Errorf("error after copying %v bytes: %v", n, err)
+		return nil, fmt.Errorf("error after copying %v bytes: %w", n, err)
 	}
 
 	err = tmp.Close()
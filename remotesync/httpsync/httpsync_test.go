@@ -0,0 +1,1047 @@
+package httpsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/metrics"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+func addRandomFile(t *testing.T, storage cafs.FileStorage, size int) (cafs.File, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	temp := storage.Create("random data")
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	return temp.File(), data
+}
+
+func assertContent(t *testing.T, file cafs.File, data []byte) {
+	r := file.Open()
+	defer r.Close()
+	if b, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	} else if !bytes.Equal(b, data) {
+		t.Fatalf("Content differs")
+	}
+}
+
+// Function legacyHandler simulates a peer that predates the protocol handshake.
+func legacyHandler(file cafs.File, perm shuffle.Permutation) http.Handler {
+	syncinfo := &remotesync.SyncInfo{Perm: perm}
+	syncinfo.SetChunksFromFile(file)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_ = json.NewEncoder(w).Encode(syncinfo)
+			return
+		}
+		chunks := remotesync.ChunksOfFile(file)
+		defer chunks.Dispose()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		_ = remotesync.WriteChunkData(chunks, 0, bufio.NewReader(r.Body), perm,
+			remotesync.SimpleFlushWriter{W: w, F: w.(http.Flusher)}, nil)
+	})
+}
+
+// Function futureHandler simulates a peer that answers with a modified handshake.
+func futureHandler(mod func(h *remotesync.Handshake)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hs := remotesync.LocalHandshake()
+		mod(&hs)
+		writeHandshake(w.Header(), hs)
+		http.Error(w, "unsupported", http.StatusBadRequest)
+	})
+}
+
+func TestSyncFrom(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 1<<20)
+	defer fileA.Dispose()
+
+	handler := NewFileHandlerFromFile(fileA, rand.Perm(16))
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	fileB, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	defer fileB.Dispose()
+	assertContent(t, fileB, data)
+}
+
+func TestSyncFromStats(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, _ := addRandomFile(t, storeA, 1<<20)
+	defer fileA.Dispose()
+
+	handler := NewFileHandlerFromFile(fileA, rand.Perm(16))
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// The second sync finds all chunks locally
+	for i, expected := range []int64{fileA.Size(), 0} {
+		var updates int
+		var stats remotesync.TransferStats
+		opts := SyncOptions{Observer: remotesync.TransferObserverFunc(func(s remotesync.TransferStats) {
+			updates++
+			stats = s
+		})}
+		fileB, err := SyncFromWithOptions(context.Background(), storeB, server.Client(), server.URL, "synced", opts)
+		if err != nil {
+			t.Fatalf("Error syncing: %v", err)
+		}
+		defer fileB.Dispose()
+		if !stats.Done() || stats.BytesTotal != fileA.Size() || int64(stats.ChunksTotal) != fileA.NumChunks() {
+			t.Errorf("Sync %d: unexpected stats %#v", i, stats)
+		}
+		if stats.BytesTransferred != expected || stats.BytesReused != fileA.Size()-expected {
+			t.Errorf("Sync %d: expected %d bytes transferred, got %v", i, expected, stats)
+		}
+		if updates < stats.ChunksTotal {
+			t.Errorf("Sync %d: expected at least one update per chunk, got %d", i, updates)
+		}
+	}
+}
+
+func TestSyncFromSyncInfoHandler(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	storeC := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 1<<20)
+	defer fileA.Dispose()
+
+	handlerA := NewFileHandlerFromFile(fileA, rand.Perm(16))
+	defer handlerA.Dispose()
+	serverA := httptest.NewServer(handlerA)
+	defer serverA.Close()
+
+	// B forwards chunks to C as soon as they arrive from A
+	var syncinfo remotesync.SyncInfo
+	syncinfo.SetChunksFromFile(fileA)
+	syncinfo.SetPermutation(rand.Perm(16))
+	serverB := httptest.NewServer(NewFileHandlerFromSyncInfo(&syncinfo, storeB))
+	defer serverB.Close()
+
+	var fileC cafs.File
+	result := make(chan error, 1)
+	go func() {
+		var err error
+		fileC, err = SyncFrom(context.Background(), storeC, serverB.Client(), serverB.URL, "forwarded")
+		result <- err
+	}()
+
+	fileB, err := SyncFrom(context.Background(), storeB, serverA.Client(), serverA.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	defer fileB.Dispose()
+	if err := <-result; err != nil {
+		t.Fatalf("Error syncing forwarded file: %v", err)
+	}
+	defer fileC.Dispose()
+	assertContent(t, fileC, data)
+}
+
+func TestDefaultPermutation(t *testing.T) {
+	fileA, data := addRandomFile(t, ram.NewRamStorage(4<<20), 1<<20)
+	defer fileA.Dispose()
+	storeB := ram.NewRamStorage(4 << 20)
+	temp := storeB.Create("copy")
+	defer temp.Dispose()
+	_, _ = temp.Write(data)
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error storing copy: %v", err)
+	}
+	fileB := temp.File()
+	defer fileB.Dispose()
+
+	// Peers serving the same file agree on the permutation
+	handlerA := NewFileHandlerFromFile(fileA, nil)
+	defer handlerA.Dispose()
+	handlerB := NewFileHandlerFromFile(fileB, nil)
+	defer handlerB.Dispose()
+	if len(handlerA.syncinfo.Perm) != shuffle.SizeFor(fileA.Size()) {
+		t.Errorf("Unexpected permutation length %d", len(handlerA.syncinfo.Perm))
+	}
+	if fmt.Sprint(handlerA.syncinfo.Perm) != fmt.Sprint(handlerB.syncinfo.Perm) {
+		t.Errorf("Permutations differ")
+	}
+}
+
+func TestSyncInfoCompactForCapablePeers(t *testing.T) {
+	fileA, _ := addRandomFile(t, ram.NewRamStorage(4<<20), 1<<20)
+	defer fileA.Dispose()
+	handler := NewFileHandlerFromFile(fileA, nil)
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, legacy := range []bool{false, true} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if !legacy {
+			writeHandshake(req.Header, remotesync.LocalHandshake())
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Error requesting SyncInfo: %v", err)
+		}
+		var fields map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&fields)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Error decoding SyncInfo: %v", err)
+		}
+		if _, hasPerm := fields["Perm"]; hasPerm != legacy {
+			t.Errorf("Legacy peer: %v, permutation transmitted: %v", legacy, hasPerm)
+		}
+	}
+}
+
+func TestSyncFromLegacyPeer(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 1<<20)
+	defer fileA.Dispose()
+
+	server := httptest.NewServer(legacyHandler(fileA, rand.Perm(16)))
+	defer server.Close()
+
+	fileB, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	defer fileB.Dispose()
+	assertContent(t, fileB, data)
+}
+
+func TestSyncFromIncompatiblePeer(t *testing.T) {
+	storage := ram.NewRamStorage(4 << 20)
+	for _, mod := range []func(h *remotesync.Handshake){
+		func(h *remotesync.Handshake) { h.Version, h.MinVersion = 5, 4 },
+		func(h *remotesync.Handshake) { h.Hash = "blake2b" },
+	} {
+		server := httptest.NewServer(futureHandler(mod))
+		_, err := SyncFrom(context.Background(), storage, server.Client(), server.URL, "synced")
+		server.Close()
+		if _, ok := err.(*remotesync.IncompatibleError); !ok {
+			t.Errorf("Expected *remotesync.IncompatibleError, got %#v", err)
+		}
+	}
+}
+
+func TestHandlerRejectsIncompatiblePeer(t *testing.T) {
+	storage := ram.NewRamStorage(4 << 20)
+	file, _ := addRandomFile(t, storage, 1024)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, shuffle.Permutation{0})
+	defer handler.Dispose()
+
+	// A legacy client doesn't send a handshake and must be served.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Legacy request failed with status %v", w.Code)
+	}
+
+	// A client insisting on a different hash algorithm must be rejected
+	hs := remotesync.LocalHandshake()
+	hs.Hash = "md5"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	writeHandshake(r.Header, hs)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %v", w.Code)
+	}
+	if remote, err := readHandshake(w.Header()); err != nil {
+		t.Errorf("Error reading handshake from response: %v", err)
+	} else if remote.Version != remotesync.ProtocolVersion {
+		t.Errorf("Unexpected handshake in response: %v", remote)
+	}
+}
+
+func TestDisposedHandler(t *testing.T) {
+	storage := ram.NewRamStorage(4 << 20)
+	file, _ := addRandomFile(t, storage, 1024)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, nil)
+	handler.Dispose()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		if w.Code != http.StatusGone {
+			t.Errorf("%v: expected status 410, got %v", method, w.Code)
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 1<<20)
+	defer fileA.Dispose()
+
+	storeA.FreeCache()
+	lockedBefore := storeA.GetUsageInfo().Locked
+
+	gateway := NewGateway(storeA, "/cafs/")
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+	url := server.URL + gateway.PathOf(fileA.Key())
+	etag := fmt.Sprintf(`"%v"`, fileA.Key())
+
+	get := func(method string, header http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	// Plain download
+	resp, body := get(http.MethodGet, nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) || resp.Header.Get("ETag") != etag {
+		t.Fatalf("Unexpected response: %v, %d bytes, ETag %v", resp.Status, len(body), resp.Header.Get("ETag"))
+	}
+
+	// HEAD
+	resp, body = get(http.MethodHead, nil)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength != int64(len(data)) {
+		t.Errorf("Unexpected response to HEAD: %v, %d bytes, Content-Length %d", resp.Status, len(body), resp.ContentLength)
+	}
+
+	// Ranges spanning several chunks, in any order
+	for _, r := range [][2]int{{0, 0}, {100000, 300000}, {len(data) - 10, len(data) - 1}, {5, 6}} {
+		resp, body = get(http.MethodGet, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", r[0], r[1])}})
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[r[0]:r[1]+1]) {
+			t.Errorf("Unexpected response to range %v: %v, %d bytes", r, resp.Status, len(body))
+		}
+	}
+
+	// If-Range with a matching ETag returns the range, otherwise the whole file
+	resp, body = get(http.MethodGet, http.Header{"Range": {"bytes=10-19"}, "If-Range": {etag}})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[10:20]) {
+		t.Errorf("Unexpected response to matching If-Range: %v", resp.Status)
+	}
+	resp, body = get(http.MethodGet, http.Header{"Range": {"bytes=10-19"}, "If-Range": {`"other"`}})
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("Unexpected response to mismatching If-Range: %v", resp.Status)
+	}
+	resp, _ = get(http.MethodGet, http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Unexpected response to If-None-Match: %v", resp.Status)
+	}
+
+	// Unknown and invalid keys
+	if resp, err := http.Get(server.URL + gateway.PathOf(cafs.SKey{1})); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown key, got %v, %v", resp, err)
+	}
+	if resp, err := http.Get(server.URL + "/cafs/xyz"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid key, got %v, %v", resp, err)
+	}
+
+	// The same URL speaks the sync protocol
+	fileB, err := SyncFrom(context.Background(), storeB, http.DefaultClient, url, "synced via gateway")
+	if err != nil {
+		t.Fatalf("Error syncing via gateway: %v", err)
+	}
+	defer fileB.Dispose()
+	assertContent(t, fileB, data)
+
+	// All resources have been released
+	storeA.FreeCache()
+	if locked := storeA.GetUsageInfo().Locked; locked != lockedBefore {
+		t.Errorf("Expected %d bytes to be locked, got %d", lockedBefore, locked)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	storeA.FreeCache()
+	lockedBefore := storeA.GetUsageInfo().Locked
+	fileA, data := addRandomFile(t, storeA, 256*1024)
+	fileB, _ := addRandomFile(t, storeA, 1024)
+
+	registry := NewRegistry("/file/")
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	keyA := fileA.Key()
+	pathA := registry.Offer(fileA, 0)
+	pathB := registry.Offer(fileB, time.Hour)
+	fileA.Dispose()
+
+	// Offered files can be synced and are listed
+	fileC, err := SyncFrom(context.Background(), storeB, http.DefaultClient, server.URL+pathA, "synced via registry")
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	assertContent(t, fileC, data)
+	fileC.Dispose()
+
+	var offers []Offer
+	resp, err := http.Get(server.URL + "/file/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&offers)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding offers: %v", err)
+	}
+	if len(offers) != 2 || offers[0].Path > offers[1].Path {
+		t.Fatalf("Unexpected offers: %v", offers)
+	}
+	for _, offer := range offers {
+		if offer.Path == pathA && offer.Expires != nil || offer.Path == pathB && offer.Expires == nil {
+			t.Errorf("Unexpected expiry of %v: %v", offer.Path, offer.Expires)
+		}
+	}
+
+	// Offering again updates the expiry, and offers expire
+	registry.Offer(fileB, 10*time.Millisecond)
+	fileB.Dispose()
+	time.Sleep(100 * time.Millisecond)
+	if offers := registry.List(); len(offers) != 1 || offers[0].Path != pathA {
+		t.Errorf("Expected only %v to be offered, got %v", pathA, offers)
+	}
+	if resp, err := http.Get(server.URL + pathB); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for expired offer, got %v, %v", resp, err)
+	}
+
+	// Withdrawn offers aren't served anymore, and the files are released
+	if !registry.Withdraw(keyA) || registry.Withdraw(keyA) {
+		t.Errorf("Expected withdrawal to succeed exactly once")
+	}
+	if resp, err := http.Get(server.URL + pathA); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for withdrawn offer, got %v, %v", resp, err)
+	}
+	storeA.FreeCache()
+	if locked := storeA.GetUsageInfo().Locked; locked != lockedBefore {
+		t.Errorf("Expected %d bytes to be locked, got %d", lockedBefore, locked)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 256*1024)
+	defer fileA.Dispose()
+	key := fileA.Key()
+
+	// Peer A holds the file, peer B doesn't, and the third peer isn't reachable
+	newPeer := func(storage cafs.FileStorage) *httptest.Server {
+		gateway := NewGateway(storage, "/cafs/")
+		mux := http.NewServeMux()
+		mux.Handle("/cafs/", gateway)
+		mux.Handle("/have", NewHaveHandler(storage, gateway))
+		return httptest.NewServer(mux)
+	}
+	peerA, peerB := newPeer(storeA), newPeer(storeB)
+	defer peerA.Close()
+	defer peerB.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	peers := []string{peerB.URL, dead.URL, peerA.URL + "/"}
+	holders := Locate(context.Background(), http.DefaultClient, peers, "/have", key, nil)
+	if len(holders) != 1 || holders[0].Peer != peerA.URL+"/" || holders[0].Size != int64(len(data)) {
+		t.Fatalf("Unexpected holders: %#v", holders)
+	}
+	if holders[0].URL != peerA.URL+"/cafs/"+key.String() {
+		t.Errorf("Unexpected URL: %v", holders[0].URL)
+	}
+	fileB, err := SyncFrom(context.Background(), storeB, http.DefaultClient, holders[0].URL, "located")
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	assertContent(t, fileB, data)
+	fileB.Dispose()
+
+	// Now both peers have it
+	if holders := Locate(context.Background(), http.DefaultClient, peers, "/have", key, nil); len(holders) != 2 {
+		t.Errorf("Expected 2 holders, got %#v", holders)
+	}
+	if resp, err := http.Get(peerA.URL + "/have?key=invalid"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid key, got %v, %v", resp, err)
+	}
+}
+
+// Struct priorityRecorder is a Limiter remembering the priorities it has been asked for.
+type priorityRecorder struct {
+	mutex      sync.Mutex
+	priorities map[ratelimit.Priority]bool
+}
+
+func (l *priorityRecorder) Wait(_ context.Context, p ratelimit.Priority, n int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.priorities[p] = true
+	return nil
+}
+
+func TestPriorityRequiresAuthentication(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	fileA, _ := addRandomFile(t, storeA, 64*1024)
+	defer fileA.Dispose()
+
+	limiter := &priorityRecorder{priorities: make(map[ratelimit.Priority]bool)}
+	signer := NewURLSigner([]byte("signing secret"))
+	auth := NewAuth(FirstOf(BearerTokens{"secret": "client"}, signer), PolicyFunc(func(id *Identity, action Action, key *cafs.SKey) bool {
+		return true
+	}))
+	handler := NewFileHandlerFromFile(fileA, nil).WithLimiter(limiter).WithAuth(auth)
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	syncUrgently := func(url string, header http.Header) map[ratelimit.Priority]bool {
+		limiter.mutex.Lock()
+		limiter.priorities = make(map[ratelimit.Priority]bool)
+		limiter.mutex.Unlock()
+		opts := SyncOptions{Priority: ratelimit.Urgent, Header: header}
+		file, err := SyncFromWithOptions(context.Background(), ram.NewRamStorage(4<<20), http.DefaultClient, url, "priority", opts)
+		if err != nil {
+			t.Fatalf("Error syncing: %v", err)
+		}
+		file.Dispose()
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		return limiter.priorities
+	}
+
+	// Anonymous clients and holders of signed URLs are limited to the default maximum,
+	// authenticated clients are not
+	if p := syncUrgently(server.URL, nil); len(p) != 1 || !p[ratelimit.Normal] {
+		t.Errorf("Expected anonymous client to be served at normal priority, got %v", p)
+	}
+	signed, err := signer.Sign(server.URL, fileA.Key(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := syncUrgently(signed, nil); len(p) != 1 || !p[ratelimit.Normal] {
+		t.Errorf("Expected signed URL to be served at normal priority, got %v", p)
+	}
+	if p := syncUrgently(server.URL, http.Header{"Authorization": {"Bearer secret"}}); len(p) != 1 || !p[ratelimit.Urgent] {
+		t.Errorf("Expected authenticated client to be served urgently, got %v", p)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 256*1024)
+	defer fileA.Dispose()
+	fileB, _ := addRandomFile(t, storeA, 1024)
+	defer fileB.Dispose()
+	keyA, keyB := fileA.Key(), fileB.Key()
+
+	signer := NewURLSigner([]byte("secret"))
+	policy := NewAccessList().
+		Grant("admin", ActionRead).
+		Grant("admin", ActionAdmin).
+		Grant("guest", ActionRead, keyB)
+	auth := NewAuth(FirstOf(BearerTokens{"t-admin": "admin", "t-guest": "guest"}, signer), policy)
+
+	mux := http.NewServeMux()
+	gateway := NewGateway(storeA, "/cafs/").WithAuth(auth)
+	mux.Handle("/cafs/", gateway)
+	mux.Handle("/admin", auth.Require(ActionAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, IdentityFromContext(r.Context()))
+	})))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	urlA := server.URL + gateway.PathOf(keyA)
+	urlB := server.URL + gateway.PathOf(keyB)
+
+	status := func(url, token string) int {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	sign := func(url string, key cafs.SKey, expires time.Time) string {
+		signed, err := signer.Sign(url, key, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	signedA := sign(urlA, keyA, time.Now().Add(time.Hour))
+	expiredA := sign(urlA, keyA, time.Now().Add(-time.Minute))
+	// A URL signed for A doesn't grant access to B
+	signedForAatB := sign(urlB, keyA, time.Now().Add(time.Hour))
+	tamperedA := signedA[:len(signedA)-1] + "0"
+	if tamperedA == signedA {
+		tamperedA = signedA[:len(signedA)-1] + "1"
+	}
+
+	for _, c := range []struct {
+		url, token string
+		expected   int
+	}{
+		{urlA, "", http.StatusUnauthorized},
+		{urlA, "wrong", http.StatusUnauthorized},
+		{urlA, "t-admin", http.StatusOK},
+		{urlA, "t-guest", http.StatusForbidden},
+		{urlB, "t-guest", http.StatusOK},
+		{signedA, "", http.StatusOK},
+		{expiredA, "", http.StatusUnauthorized},
+		{tamperedA, "", http.StatusUnauthorized},
+		{signedForAatB, "", http.StatusForbidden},
+		{server.URL + "/admin", "", http.StatusUnauthorized},
+		{server.URL + "/admin", "t-guest", http.StatusForbidden},
+		{server.URL + "/admin", "t-admin", http.StatusOK},
+	} {
+		if s := status(c.url, c.token); s != c.expected {
+			t.Errorf("GET %v with token %#v: expected %v, got %v", c.url, c.token, c.expected, s)
+		}
+	}
+
+	// Files can be synced using a signed URL or credentials passed as headers
+	fileC, err := SyncFrom(context.Background(), storeB, http.DefaultClient, signedA, "synced via signed URL")
+	if err != nil {
+		t.Fatalf("Error syncing via signed URL: %v", err)
+	}
+	assertContent(t, fileC, data)
+	fileC.Dispose()
+
+	opts := SyncOptions{Header: http.Header{"Authorization": {"Bearer t-admin"}}}
+	fileC, err = SyncFromWithOptions(context.Background(), storeB, http.DefaultClient, urlA, "synced with token", opts)
+	if err != nil {
+		t.Fatalf("Error syncing with token: %v", err)
+	}
+	assertContent(t, fileC, data)
+	fileC.Dispose()
+
+	if _, err := SyncFrom(context.Background(), storeB, http.DefaultClient, urlA, "unauthorized"); err == nil {
+		t.Error("Expected unauthorized sync to fail")
+	}
+
+	// FileHandlers check the key of the file they serve
+	handler := NewFileHandlerFromFile(fileA, nil).WithAuth(auth)
+	defer handler.Dispose()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer t-guest")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected guest to be forbidden from reading A, got %v", w.Code)
+	}
+}
+
+// Creates a certificate signed by `parent`, or a self-signed CA if `parent` is nil, and writes it and
+// its key into PEM files in `dir`. Returns the certificate, its key and the files' paths.
+func writeCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCertificate(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCertificate(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCertificate(t, dir, "client", ca, caKey)
+	_, _, otherCA, _ := writeCertificate(t, dir, "other", nil, nil)
+
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 256*1024)
+	handler := NewFileHandlerFromFile(fileA, nil).
+		WithAuth(NewAuth(ClientCertificates{}, NewAccessList().Grant("client", ActionRead)))
+	fileA.Dispose()
+	defer handler.Dispose()
+
+	serverConfig, err := LoadServerTLSConfig(serverCert, serverKey, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = serverConfig
+	// Failing handshakes are expected
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	sync := func(caFile, certFile, keyFile string) (cafs.File, error) {
+		config, err := LoadClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SyncFrom(context.Background(), storeB, NewClient(config), server.URL, "synced via TLS")
+	}
+
+	// Mutual TLS identifies the client
+	fileB, err := sync(caFile, clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("Error syncing via mutual TLS: %v", err)
+	}
+	assertContent(t, fileB, data)
+	fileB.Dispose()
+
+	// Without a client certificate, the connection succeeds but access is denied
+	if _, err := sync(caFile, "", ""); err == nil {
+		t.Error("Expected sync without client certificate to fail")
+	}
+	// The server's certificate must be verified
+	if _, err := sync(otherCA, clientCert, clientKey); err == nil {
+		t.Error("Expected sync from unverified server to fail")
+	}
+
+	if _, err := LoadServerTLSConfig(serverCert, serverKey, serverKey); err == nil {
+		t.Error("Expected loading a file without certificates as CA to fail")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	storeA := ram.NewRamStorage(8 << 20)
+	storeB := ram.NewRamStorage(8 << 20)
+	registry := NewRegistry("/file/")
+	var files [][]byte
+	var paths []string
+	for i := 0; i < 3; i++ {
+		file, data := addRandomFile(t, storeA, 256*1024)
+		paths = append(paths, registry.Offer(file, 0))
+		files = append(files, data)
+		file.Dispose()
+	}
+	defer registry.Clear()
+
+	var mutex sync.Mutex
+	var protos []string
+	checkProtos := func(expected string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, proto := range protos {
+			if proto != expected {
+				t.Errorf("Expected %v, got %v", expected, proto)
+			}
+		}
+		protos = nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/file/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		protos = append(protos, r.Proto)
+		mutex.Unlock()
+		registry.ServeHTTP(w, r)
+	}))
+	server := httptest.NewUnstartedServer(mux)
+	EnableHTTP2(server.Config)
+	var conns int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	syncAll := func(client *http.Client) {
+		for i, path := range paths {
+			file, err := SyncFrom(context.Background(), storeB, client, server.URL+path, "synced via HTTP/2")
+			if err != nil {
+				t.Fatalf("Error syncing %v: %v", path, err)
+			}
+			assertContent(t, file, files[i])
+			file.Dispose()
+		}
+	}
+
+	// All files are synced over a single full-duplex connection
+	syncAll(NewH2CClient(nil))
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected a single connection, got %v", n)
+	}
+	checkProtos("HTTP/2.0")
+
+	// HTTP/1.1 clients still work, using a connection per POST
+	atomic.StoreInt32(&conns, 0)
+	syncAll(NewClient(nil))
+	if n := atomic.LoadInt32(&conns); n < int32(len(paths)) {
+		t.Errorf("Expected at least %v connections, got %v", len(paths), n)
+	}
+	checkProtos("HTTP/1.1")
+
+	// h2c clients fall back to HTTP/1.1 for servers not speaking h2c
+	server1 := httptest.NewServer(mux)
+	defer server1.Close()
+	client := NewH2CClient(nil)
+	for i, path := range paths {
+		file, err := SyncFrom(context.Background(), storeB, client, server1.URL+path, "synced via fallback")
+		if err != nil {
+			t.Fatalf("Error syncing %v via fallback: %v", path, err)
+		}
+		assertContent(t, file, files[i])
+		file.Dispose()
+	}
+	checkProtos("HTTP/1.1")
+}
+
+func TestDiscovery(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		if lo, err = net.InterfaceByName("lo0"); err != nil {
+			t.Skip("no loopback interface")
+		}
+	}
+	group := fmt.Sprintf("239.255.67.65:%d", 20000+rand.Intn(10000))
+	newDiscovery := func(url string, capacity int64) *Discovery {
+		d, err := NewDiscovery(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.WithInterface(lo).WithInterval(20 * time.Millisecond).WithAnnouncement(func() Announcement {
+			return Announcement{URL: url, Capacity: capacity}
+		})
+	}
+	// Intervals that would break the ticker are clamped
+	if d := newDiscovery("http://:8080", 0).WithInterval(0); d.interval != minAnnouncementInterval {
+		t.Errorf("Unexpected interval: %v", d.interval)
+	}
+	// Until told the address, peers take it from the announcement's sender
+	a := newDiscovery("http://:8080", 1000)
+	b := newDiscovery("https://127.0.0.1:8443", 2000)
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneA, doneB := make(chan error, 1), make(chan error, 1)
+	go func() { doneA <- a.Run(ctxA) }()
+	go func() { doneB <- b.Run(ctxB) }()
+
+	waitFor := func(what string, cond func() bool) {
+		for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+			select {
+			case err := <-doneA:
+				t.Skipf("multicast unavailable: %v", err)
+			default:
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Timeout waiting for %v: %#v, %#v", what, a.Peers(), b.Peers())
+			}
+		}
+	}
+	waitFor("peers", func() bool { return len(a.Peers()) == 1 && len(b.Peers()) == 1 })
+	if p := a.Peers()[0]; p.ID != b.ID() || p.URL != "https://127.0.0.1:8443" || p.Capacity != 2000 || !p.Alive {
+		t.Errorf("Unexpected peer of A: %#v", p)
+	}
+	if p := b.Peers()[0]; p.ID != a.ID() || p.URL != "http://127.0.0.1:8080" || p.Capacity != 1000 || !p.Alive {
+		t.Errorf("Unexpected peer of B: %#v", p)
+	}
+
+	// Leaving peers are removed right away
+	cancelB()
+	if err := <-doneB; err != nil {
+		t.Fatal(err)
+	}
+	waitFor("B to leave", func() bool { return len(a.Peers()) == 0 })
+
+	// Peers falling silent are dead first, and forgotten later
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7465}
+	if err := a.update(Announcement{ID: "c", URL: "http://:80", Interval: time.Millisecond}, from, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"ftp://host:21", "http://10.0.0.2:80", "http://example.com:80"} {
+		if err := a.update(Announcement{ID: "d", URL: url}, from, time.Now()); err == nil {
+			t.Errorf("Expected %v to be rejected", url)
+		}
+	}
+	if peers := a.Peers(); len(peers) != 1 || peers[0].URL != "http://10.0.0.1:80" || peers[0].Interval != minAnnouncementInterval {
+		t.Fatalf("Unexpected peers: %#v", peers)
+	}
+	time.Sleep(4 * minAnnouncementInterval)
+	if peers := a.Peers(); len(peers) != 1 || peers[0].Alive {
+		t.Errorf("Expected C to be dead: %#v", peers)
+	}
+	time.Sleep(30 * minAnnouncementInterval)
+	if peers := a.Peers(); len(peers) != 0 {
+		t.Errorf("Expected C to be forgotten: %#v", peers)
+	}
+	// The table is bounded
+	for i := 0; i < maxDiscoveredPeers; i++ {
+		announcement := Announcement{ID: fmt.Sprint("peer", i), URL: fmt.Sprintf("http://:%d", 1000+i), Interval: time.Hour}
+		if err := a.update(announcement, from, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.update(Announcement{ID: "one too many", URL: "http://:80"}, from, time.Now()); err == nil {
+		t.Error("Expected table to be full")
+	}
+	// Only the peer itself may announce that it leaves
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7465}
+	if err := a.update(Announcement{ID: "peer0", URL: "http://:1000", Leaving: true}, other, time.Now()); err == nil {
+		t.Error("Expected leave from other address to be rejected")
+	}
+	if err := a.update(Announcement{ID: "peer0", URL: "http://:1000", Leaving: true}, from, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.update(Announcement{ID: "peer0", URL: "http://:1000", Interval: time.Hour}, from, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if peers := a.Peers(); len(peers) != maxDiscoveredPeers || peers[0].Interval != maxAnnouncementInterval {
+		t.Errorf("Unexpected peers: %d", len(peers))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	fileA, data := addRandomFile(t, storeA, 1<<20)
+	defer fileA.Dispose()
+
+	senderMetrics, receiverMetrics := NewMetrics(), NewMetrics()
+	handler := NewFileHandlerFromFile(fileA, nil).WithMetrics(senderMetrics)
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	opts := SyncOptions{Metrics: receiverMetrics}
+	storeB := ram.NewRamStorage(4 << 20)
+	fileB, err := SyncFromWithOptions(context.Background(), storeB, http.DefaultClient, server.URL, "metrics", opts)
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	assertContent(t, fileB, data)
+	fileB.Dispose()
+
+	// Nothing needs to be sent again
+	fileB, err = SyncFromWithOptions(context.Background(), storeB, http.DefaultClient, server.URL, "metrics", opts)
+	if err != nil {
+		t.Fatalf("Error syncing again: %v", err)
+	}
+	fileB.Dispose()
+
+	// The receiver runs out of space before the transfer starts
+	_, err = SyncFromWithOptions(context.Background(), ram.NewRamStorage(64<<10), http.DefaultClient, server.URL, "metrics", opts)
+	if err == nil {
+		t.Fatal("Expected sync into small storage to fail")
+	}
+
+	if m := receiverMetrics; m.receivedBytes.Value() != int64(len(data)) || m.reusedBytes.Value() != int64(len(data)) ||
+		m.reusedChunks.Value() != m.receivedChunks.Value() || m.errors.With(sideReceive, "space").Value() != 1 {
+		t.Errorf("Unexpected receiver metrics: received %v, reused %v", m.receivedBytes.Value(), m.reusedBytes.Value())
+	}
+	// The handler sends asynchronously, so wait for the last transfer to be accounted for
+	for start := time.Now(); senderMetrics.skippedBytes.Value() != int64(len(data)); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Unexpected sender metrics: skipped %v", senderMetrics.skippedBytes.Value())
+		}
+	}
+	if sent := senderMetrics.sentBytes.Value(); sent < int64(len(data)) {
+		t.Errorf("Expected at least %v bytes sent, got %v", len(data), sent)
+	}
+
+	var buf bytes.Buffer
+	registry := metrics.NewRegistry()
+	registry.Register(receiverMetrics.Metrics()...)
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		fmt.Sprintf(`cafs_sync_bytes_total{side="receive",kind="received"} %d`, len(data)),
+		`cafs_sync_errors_total{side="receive",type="space"} 1`,
+		`cafs_sync_duration_seconds_count{side="receive"} 2`,
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(s+"\n")) {
+			t.Errorf("Missing %v in:\n%s", s, buf.Bytes())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/metrics"
+)
+
+// Sides of a transfer, used as label values
+const (
+	sideSend    = "send"
+	sideReceive = "receive"
+)
+
+// Struct Metrics counts the chunk data transferred by FileHandlers, Gateways and SyncFromWithOptions,
+// the errors occurring while doing so, and the durations of the transfers. Transfers are accounted
+// for when they end. Transfers via remotesync.Session are not covered. A Metrics is safe for
+// concurrent use.
+type Metrics struct {
+	sentBytes, sentChunks         *metrics.Counter
+	skippedBytes, skippedChunks   *metrics.Counter
+	receivedBytes, receivedChunks *metrics.Counter
+	reusedBytes, reusedChunks     *metrics.Counter
+
+	bytes     *metrics.CounterVec
+	chunks    *metrics.CounterVec
+	errors    *metrics.CounterVec
+	durations *metrics.HistogramVec
+}
+
+// Function NewMetrics creates a Metrics. Expose it by registering its Metrics() with a
+// metrics.Registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		bytes: metrics.NewCounterVec("cafs_sync_bytes_total",
+			"Bytes of chunk data handled by syncs: sent and skipped (not requested) when sending, received and reused (already present) when receiving.",
+			"side", "kind"),
+		chunks: metrics.NewCounterVec("cafs_sync_chunks_total",
+			"Chunks handled by syncs: sent and skipped (not requested) when sending, received and reused (already present) when receiving.",
+			"side", "kind"),
+		errors: metrics.NewCounterVec("cafs_sync_errors_total",
+			"Syncs that failed while sending or receiving chunk data, by type of error.",
+			"side", "type"),
+		durations: metrics.NewHistogramVec("cafs_sync_duration_seconds",
+			"Durations of syncs from the start of the transfer until its end, successful or not.",
+			metrics.ExponentialBuckets(0.01, 4, 9), "side"),
+	}
+	m.sentBytes, m.sentChunks = m.bytes.With(sideSend, "sent"), m.chunks.With(sideSend, "sent")
+	m.skippedBytes, m.skippedChunks = m.bytes.With(sideSend, "skipped"), m.chunks.With(sideSend, "skipped")
+	m.receivedBytes, m.receivedChunks = m.bytes.With(sideReceive, "received"), m.chunks.With(sideReceive, "received")
+	m.reusedBytes, m.reusedChunks = m.bytes.With(sideReceive, "reused"), m.chunks.With(sideReceive, "reused")
+	return m
+}
+
+// Returns the metrics to register with a metrics.Registry.
+func (m *Metrics) Metrics() []metrics.Metric {
+	return []metrics.Metric{m.bytes, m.chunks, m.errors, m.durations}
+}
+
+// Accounts for a transfer by a FileHandler that has ended with `err`.
+func (m *Metrics) sent(stats remotesync.TransferStats, err error) {
+	if m == nil {
+		return
+	}
+	m.sentBytes.Add(stats.BytesTransferred)
+	m.sentChunks.Add(int64(stats.ChunksTransferred))
+	m.skippedBytes.Add(stats.BytesReused)
+	m.skippedChunks.Add(int64(stats.ChunksReused))
+	m.ended(sideSend, stats, err)
+}
+
+// Accounts for a transfer by a Builder that has ended with `err`.
+func (m *Metrics) received(stats remotesync.TransferStats, err error) {
+	if m == nil {
+		return
+	}
+	m.receivedBytes.Add(stats.BytesTransferred)
+	m.receivedChunks.Add(int64(stats.ChunksTransferred))
+	m.reusedBytes.Add(stats.BytesReused)
+	m.reusedChunks.Add(int64(stats.ChunksReused))
+	m.ended(sideReceive, stats, err)
+}
+
+func (m *Metrics) ended(side string, stats remotesync.TransferStats, err error) {
+	if !stats.Started.IsZero() {
+		m.durations.With(side).Observe(stats.Elapsed().Seconds())
+	}
+	if err != nil {
+		m.errors.With(side, errorType(err)).Inc()
+	}
+}
+
+// Classifies errors occurring during transfers, for use as a label value.
+func errorType(err error) string {
+	var incompatible *remotesync.IncompatibleError
+	var mismatch *remotesync.FileMismatchError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, cafs.ErrNotEnoughSpace):
+		return "space"
+	case errors.As(err, &incompatible):
+		return "incompatible"
+	case errors.Is(err, remotesync.ErrUnexpectedChunk), errors.As(err, &mismatch):
+		return "corrupt"
+	case errors.Is(err, remotesync.ErrDisposed):
+		return "disposed"
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrClosedPipe), errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
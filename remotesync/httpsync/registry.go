@@ -0,0 +1,278 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
+)
+
+// Struct Registry implements the http.Handler interface and serves a changing set of files using
+// the sync protocol. Each file is offered under "<prefix><first 16 hex digits of its key>", and a
+// GET request for the prefix itself lists the files currently offered as JSON.
+//
+// Files are offered for a limited time or until withdrawn. Withdrawn files stop being served
+// immediately, but their FileHandlers are disposed only after all requests in progress have finished.
+// A Registry is safe for concurrent use.
+type Registry struct {
+	prefix  string
+	log     cafs.Printer
+	limiter ratelimit.Limiter
+	auth    *Auth
+	metrics *Metrics
+
+	mutex   sync.Mutex
+	entries map[string]*registryEntry // by path relative to prefix
+}
+
+// Struct registryEntry holds a FileHandler offered by a Registry.
+type registryEntry struct {
+	key      cafs.SKey
+	size     int64
+	handler  *FileHandler
+	expires  time.Time   // zero if the offer doesn't expire
+	timer    *time.Timer // withdraws the entry when expired, or nil
+	requests int         // number of requests being served
+	removed  bool        // set when withdrawn; the handler is disposed after the last request
+}
+
+// Struct Offer describes a file currently offered by a Registry.
+type Offer struct {
+	Key     cafs.SKey
+	Size    int64
+	Path    string
+	Expires *time.Time `json:",omitempty"` // nil if the offer doesn't expire
+}
+
+// Function NewRegistry creates an empty Registry serving files under `prefix`, e.g. "/file/".
+func NewRegistry(prefix string) *Registry {
+	return &Registry{
+		prefix:  prefix,
+		log:     cafs.NewWriterPrinter(ioutil.Discard),
+		entries: make(map[string]*registryEntry),
+	}
+}
+
+// Sets the log Printer used by the Registry and all FileHandlers created afterwards.
+func (r *Registry) WithPrinter(printer cafs.Printer) *Registry {
+	r.log = printer
+	return r
+}
+
+// Limits the rate at which chunk data is sent by all FileHandlers created afterwards.
+func (r *Registry) WithLimiter(limiter ratelimit.Limiter) *Registry {
+	r.limiter = limiter
+	return r
+}
+
+// Accounts for the transfers of all FileHandlers created afterwards in `metrics`.
+func (r *Registry) WithMetrics(metrics *Metrics) *Registry {
+	r.metrics = metrics
+	return r
+}
+
+func (r *Registry) id(key cafs.SKey) string {
+	return key.String()[:16]
+}
+
+// Requires clients to be allowed to read the files offered, see ActionRead. Listing the files
+// requires ActionRead without a specific key. Applies to all FileHandlers created afterwards.
+func (r *Registry) WithAuth(auth *Auth) *Registry {
+	r.auth = auth
+	return r
+}
+
+// Returns the path under which the file identified by `key` is offered, or would be offered.
+func (r *Registry) PathOf(key cafs.SKey) string {
+	return r.prefix + r.id(key)
+}
+
+// Offers `file` for `ttl`, or until withdrawn if `ttl` is zero. The Registry keeps its own
+// handle to the file. Offering a file again only updates the time at which the offer expires.
+// Returns the path under which the file is offered.
+func (r *Registry) Offer(file cafs.File, ttl time.Duration) string {
+	key := file.Key()
+	id := r.id(key)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.entries[id]
+	if entry != nil && entry.key != key {
+		r.log.Printf("Registry: %v replaces %v", key, entry.key)
+		r.remove(id, entry)
+		entry = nil
+	}
+	if entry == nil {
+		entry = &registryEntry{
+			key:     key,
+			size:    file.Size(),
+			handler: NewFileHandlerFromFile(file, nil).WithPrinter(r.log).WithLimiter(r.limiter).WithAuth(r.auth).WithMetrics(r.metrics),
+		}
+		r.entries[id] = entry
+		r.log.Printf("Registry: offering %v under %v", key, r.prefix+id)
+	}
+
+	if entry.timer != nil {
+		entry.timer.Stop()
+		entry.timer = nil
+	}
+	entry.expires = time.Time{}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+		entry.timer = time.AfterFunc(ttl, func() { r.expire(id, entry) })
+	}
+	return r.prefix + id
+}
+
+// Withdraws the file identified by `key`. Returns false if it wasn't offered.
+func (r *Registry) Withdraw(key cafs.SKey) bool {
+	id := r.id(key)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.entries[id]
+	if entry == nil || entry.key != key {
+		return false
+	}
+	r.log.Printf("Registry: withdrawing %v", key)
+	r.remove(id, entry)
+	return true
+}
+
+// Withdraws all files.
+func (r *Registry) Clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, entry := range r.entries {
+		r.remove(id, entry)
+	}
+}
+
+// Returns the files currently offered, ordered by path.
+func (r *Registry) List() []Offer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	offers := make([]Offer, 0, len(r.entries))
+	for id, entry := range r.entries {
+		offers = append(offers, r.offer(id, entry))
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Path < offers[j].Path })
+	return offers
+}
+
+// Returns the offer of the file identified by `key`, or false if it isn't offered.
+func (r *Registry) Lookup(key cafs.SKey) (Offer, bool) {
+	id := r.id(key)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.entries[id]
+	if entry == nil || entry.key != key {
+		return Offer{}, false
+	}
+	return r.offer(id, entry), true
+}
+
+func (r *Registry) offer(id string, entry *registryEntry) Offer {
+	offer := Offer{Key: entry.key, Size: entry.size, Path: r.prefix + id}
+	if !entry.expires.IsZero() {
+		expires := entry.expires
+		offer.Expires = &expires
+	}
+	return offer
+}
+
+// Called by an entry's timer.
+func (r *Registry) expire(id string, entry *registryEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// The entry may have been withdrawn or offered again in the meantime
+	if r.entries[id] != entry || entry.expires.IsZero() || time.Now().Before(entry.expires) {
+		return
+	}
+	r.log.Printf("Registry: offer of %v expired", entry.key)
+	r.remove(id, entry)
+}
+
+// Removes an entry. Must be called with the mutex held.
+func (r *Registry) remove(id string, entry *registryEntry) {
+	delete(r.entries, id)
+	if entry.timer != nil {
+		entry.timer.Stop()
+		entry.timer = nil
+	}
+	entry.removed = true
+	if entry.requests == 0 {
+		entry.handler.Dispose()
+	}
+}
+
+// Looks up an entry and registers a request being served by it.
+func (r *Registry) acquire(id string) *registryEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.entries[id]
+	if entry != nil {
+		entry.requests++
+	}
+	return entry
+}
+
+// Unregisters a request and disposes the entry's handler if it has been withdrawn in the meantime.
+func (r *Registry) release(entry *registryEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry.requests--
+	if entry.removed && entry.requests == 0 {
+		entry.handler.Dispose()
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == r.prefix {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := r.auth.Check(w, req, ActionRead, nil); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(r.List()); err != nil {
+			r.log.Printf("Registry: error listing offers: %v", err)
+		}
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, r.prefix) {
+		http.NotFound(w, req)
+		return
+	}
+	entry := r.acquire(strings.TrimPrefix(req.URL.Path, r.prefix))
+	if entry == nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer r.release(entry)
+	entry.handler.ServeHTTP(w, req)
+}
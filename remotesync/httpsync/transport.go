@@ -0,0 +1,161 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Function LoadServerTLSConfig returns a TLS configuration for serving with the certificate and
+// private key found in the given PEM files. If `clientCAFile` is not empty, client certificates
+// are verified against the CAs found in it. Clients may still connect without a certificate, so
+// that other means of authentication remain available; use ClientCertificates to identify them.
+func LoadServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Function LoadClientTLSConfig returns a TLS configuration for connecting to servers. If `caFile`
+// is not empty, servers are verified against the CAs found in it instead of the system's. If
+// `certFile` and `keyFile` are not empty, the certificate found in them is presented to servers
+// requesting one.
+func LoadClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Function NewClient returns an HTTP client suitable for SyncFrom that uses the given TLS
+// configuration. If `config` is nil, the system's default configuration is used. HTTPS connections
+// use HTTP/2 if the server supports it, allowing many files to be synced over a single connection.
+func NewClient(config *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}
+}
+
+// Function NewH2CClient returns an HTTP client suitable for SyncFrom that speaks unencrypted HTTP/2
+// ("h2c") to http:// URLs, without trying HTTP/1.1 first, e.g. to servers set up by EnableHTTP2. Servers
+// that turn out not to support h2c are spoken to using HTTP/1.1 from then on. HTTPS connections work as
+// with NewClient.
+func NewH2CClient(config *tls.Config) *http.Client {
+	h2c := http.DefaultTransport.(*http.Transport).Clone()
+	h2c.TLSClientConfig = config
+	h2c.Protocols = new(http.Protocols)
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &h2cTransport{
+		h2c:      h2c,
+		fallback: NewClient(config).Transport,
+		http1:    make(map[string]bool),
+	}}
+}
+
+// Struct h2cTransport speaks h2c to http:// URLs and falls back to HTTP/1.1 for servers failing to.
+type h2cTransport struct {
+	h2c      http.RoundTripper
+	fallback http.RoundTripper // Used for https:// URLs and servers not speaking h2c
+
+	mutex sync.Mutex
+	http1 map[string]bool // Hosts known not to speak h2c
+}
+
+func (t *h2cTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	http1 := t.http1[r.URL.Host]
+	t.mutex.Unlock()
+	if r.URL.Scheme != "http" || http1 {
+		return t.fallback.RoundTrip(r)
+	}
+
+	resp, err := t.h2c.RoundTrip(r)
+	if err == nil {
+		return resp, nil
+	}
+	// Requests can only be repeated if their body can be read again. Requests without a body, such
+	// as those fetching a SyncInfo, are usually the first ones sent to a server.
+	retry := r
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := r.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		retry = r.Clone(r.Context())
+		retry.Body = body
+	}
+	resp, fallbackErr := t.fallback.RoundTrip(retry)
+	if fallbackErr != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	t.http1[r.URL.Host] = true
+	t.mutex.Unlock()
+	return resp, nil
+}
+
+// Function EnableHTTP2 makes `server` accept HTTP/2 on both encrypted and unencrypted connections, in
+// addition to HTTP/1.1. Unencrypted HTTP/2 requires clients with prior knowledge, see NewH2CClient.
+func EnableHTTP2(server *http.Server) {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %v", file)
+	}
+	return pool, nil
+}
@@ -17,11 +17,12 @@
 package httpsync
 
 import (
-	"github.com/indyjo/cafs"
-	"github.com/indyjo/cafs/remotesync"
+	"context"
 	"io"
 	"sync"
-	"time"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync"
 )
 
 // Interface chunksSource specifies a factory for Chunks
@@ -36,7 +37,7 @@ type fileBasedChunksSource struct {
 	file cafs.File
 }
 
-func (f fileBasedChunksSource) GetChunks() (remotesync.Chunks, error) {
+func (f *fileBasedChunksSource) GetChunks() (remotesync.Chunks, error) {
 	f.m.Lock()
 	file := f.file
 	f.m.Unlock()
@@ -46,7 +47,7 @@ func (f fileBasedChunksSource) GetChunks() (remotesync.Chunks, error) {
 	return remotesync.ChunksOfFile(file), nil
 }
 
-func (f fileBasedChunksSource) Dispose() {
+func (f *fileBasedChunksSource) Dispose() {
 	f.m.Lock()
 	file := f.file
 	f.file = nil
@@ -58,6 +59,7 @@ func (f fileBasedChunksSource) Dispose() {
 
 // Struct syncInfoChunksSource implements ChunksSource using only a SyncInfo object.
 // It requests chunks from a FileStore and waits until that chunk becomes available.
+// Storages implementing cafs.WaitableStorage notify about arriving chunks, others are polled.
 // There is no guarantee that chunks are kept or will actually become available at some
 // time.
 type syncInfoChunksSource struct {
@@ -66,10 +68,12 @@ type syncInfoChunksSource struct {
 }
 
 func (s syncInfoChunksSource) GetChunks() (remotesync.Chunks, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &syncInfoChunks{
 		chunks:  s.syncinfo.Chunks,
 		storage: s.storage,
-		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
 	}, nil
 }
 
@@ -80,7 +84,8 @@ func (s syncInfoChunksSource) Dispose() {
 type syncInfoChunks struct {
 	chunks  []remotesync.ChunkInfo
 	storage cafs.FileStorage
-	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
 }
 
 func (s *syncInfoChunks) NextChunk() (cafs.File, error) {
@@ -89,26 +94,13 @@ func (s *syncInfoChunks) NextChunk() (cafs.File, error) {
 	}
 	key := s.chunks[0].Key
 	s.chunks = s.chunks[1:]
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer func() {
-		ticker.Stop()
-	}()
-	for {
-		if f, err := s.storage.Get(&key); err == nil {
-			return f, nil
-		} else if err != cafs.ErrNotFound {
-			return nil, err
-		}
-
-		select {
-		case <-s.done:
-			return nil, remotesync.ErrDisposed
-		case <-ticker.C:
-			// next try
-		}
+	f, err := cafs.WaitFor(s.ctx, s.storage, &key)
+	if err != nil && s.ctx.Err() != nil {
+		return nil, remotesync.ErrDisposed
 	}
+	return f, err
 }
 
 func (s *syncInfoChunks) Dispose() {
-	close(s.done)
+	s.cancel()
 }
@@ -0,0 +1,335 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package metrics implements counters, gauges and histograms that are exposed in the text format
+// understood by Prometheus. It covers only what is needed by CAFS services and has no dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Interface Metric is implemented by everything that can be registered with a Registry.
+type Metric interface {
+	// Writes the metric's HELP and TYPE lines and all of its samples in the text exposition format.
+	WriteText(w io.Writer) error
+}
+
+// Struct Registry collects metrics and exposes them. A Registry is safe for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []Metric
+}
+
+// Function NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Adds metrics to the registry. They are written in the order of registration.
+func (r *Registry) Register(metrics ...Metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, metrics...)
+}
+
+// Writes all metrics registered in the text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]Metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if err := m.WriteText(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Serves the metrics registered, e.g. under "/metrics".
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
+
+// Struct desc holds what all metrics have in common.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) error {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, d.typ)
+	return err
+}
+
+// Writes a sample named `name` (the metric's name plus an optional suffix), labeled with the
+// metric's labels set to `values`, followed by `extra` label pairs.
+func (d *desc) writeSample(w io.Writer, name string, values []string, value float64, extra ...string) error {
+	var b strings.Builder
+	b.WriteString(name)
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) > 0 {
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	b.WriteString(" " + formatValue(value) + "\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Struct vec manages the children of a metric, one for each combination of label values.
+type vec struct {
+	desc
+	mutex    sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string // label values by child key
+	create   func() interface{}
+}
+
+func newVec(name, help, typ string, labels []string, create func() interface{}) vec {
+	return vec{
+		desc:     desc{name: name, help: help, typ: typ, labels: labels},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		create:   create,
+	}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %v has labels %v, got values %v", v.name, v.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	child := v.children[key]
+	if child == nil {
+		child = v.create()
+		v.children[key] = child
+		v.values[key] = append([]string(nil), values...)
+	}
+	return child
+}
+
+// Calls `f` for all children, ordered by their label values.
+func (v *vec) each(f func(values []string, child interface{}) error) error {
+	v.mutex.Lock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]interface{}, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		children[i], values[i] = v.children[key], v.values[key]
+	}
+	v.mutex.Unlock()
+
+	for i := range children {
+		if err := f(values[i], children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Struct Counter is a value that only ever increases.
+type Counter struct {
+	value atomic.Int64
+}
+
+// Increases the counter by `n`, which must not be negative.
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+// Increases the counter by one.
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Returns the counter's current value.
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Struct CounterVec is a metric consisting of one Counter per combination of label values.
+type CounterVec struct {
+	vec
+}
+
+// Function NewCounterVec creates a counter metric with the given labels. Without labels, the metric
+// consists of a single Counter returned by With().
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels, func() interface{} { return new(Counter) })}
+}
+
+// Returns the Counter for the given label values, creating it if necessary.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values).(*Counter)
+}
+
+func (c *CounterVec) WriteText(w io.Writer) error {
+	if err := c.writeHeader(w); err != nil {
+		return err
+	}
+	return c.each(func(values []string, child interface{}) error {
+		return c.writeSample(w, c.name, values, float64(child.(*Counter).Value()))
+	})
+}
+
+// Struct Histogram counts observations in buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64 // upper bounds, ascending
+	counts  []uint64  // per bucket, not cumulative; the last one counts what exceeds all bounds
+	sum     float64
+}
+
+// Records an observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+// Struct HistogramVec is a metric consisting of one Histogram per combination of label values.
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// Function NewHistogramVec creates a histogram metric with the given bucket upper bounds, which must
+// be ascending, and labels. Without labels, the metric consists of a single Histogram returned by
+// With().
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	create := func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+	}
+	return &HistogramVec{newVec(name, help, "histogram", labels, create), buckets}
+}
+
+// Returns the Histogram for the given label values, creating it if necessary.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values).(*Histogram)
+}
+
+func (h *HistogramVec) WriteText(w io.Writer) error {
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	return h.each(func(values []string, child interface{}) error {
+		hist := child.(*Histogram)
+		hist.mutex.Lock()
+		counts := append([]uint64(nil), hist.counts...)
+		sum := hist.sum
+		hist.mutex.Unlock()
+
+		var cumulative uint64
+		for i, count := range counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			if err := h.writeSample(w, h.name+"_bucket", values, float64(cumulative), "le", formatValue(le)); err != nil {
+				return err
+			}
+		}
+		if err := h.writeSample(w, h.name+"_sum", values, sum); err != nil {
+			return err
+		}
+		return h.writeSample(w, h.name+"_count", values, float64(cumulative))
+	})
+}
+
+// Function ExponentialBuckets returns `count` bucket upper bounds, the first being `start` and each
+// following one `factor` times its predecessor.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Struct funcMetric is a metric without labels whose value is obtained on demand.
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+// Function NewGaugeFunc creates a gauge whose value is obtained by calling `f` whenever it is exposed.
+// The function must be safe for concurrent use.
+func NewGaugeFunc(name, help string, f func() float64) Metric {
+	return &funcMetric{desc{name: name, help: help, typ: "gauge"}, f}
+}
+
+// Function NewCounterFunc creates a counter whose value is obtained by calling `f` whenever it is
+// exposed, e.g. for counters maintained elsewhere. The function must be safe for concurrent use.
+func NewCounterFunc(name, help string, f func() float64) Metric {
+	return &funcMetric{desc{name: name, help: help, typ: "counter"}, f}
+}
+
+func (m *funcMetric) WriteText(w io.Writer) error {
+	if err := m.writeHeader(w); err != nil {
+		return err
+	}
+	return m.writeSample(w, m.name, nil, m.f())
+}
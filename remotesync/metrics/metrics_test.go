@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	requests := NewCounterVec("requests_total", "Requests served.", "code")
+	durations := NewHistogramVec("duration_seconds", "Durations.", []float64{0.1, 1})
+	registry.Register(requests, durations, NewGaugeFunc("temperature", "A \"gauge\"\nover two lines.", func() float64 { return -1.5 }))
+
+	requests.With("500").Inc()
+	requests.With("200").Add(2)
+	requests.With("200").Inc()
+	durations.With().Observe(0.1)
+	durations.With().Observe(0.5)
+	durations.With().Observe(7)
+	if v := requests.With("200").Value(); v != 3 {
+		t.Errorf("Expected 3, got %v", v)
+	}
+
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="500"} 1
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 7.6
+duration_seconds_count 3
+# HELP temperature A "gauge"\nover two lines.
+# TYPE temperature gauge
+temperature -1.5
+`
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%v", buf.String())
+	}
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type: %v", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	errors := NewCounterVec("errors_total", "Errors.", "type", "side")
+	errors.With("a\"b\\c\nd", "send").Inc()
+	var buf bytes.Buffer
+	if err := errors.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `errors_total{type="a\"b\\c\nd",side="send"} 1`) {
+		t.Errorf("Unexpected output:\n%v", buf.String())
+	}
+}
@@ -0,0 +1,270 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ratelimit implements bandwidth limiting for transfers using token buckets. Transfers
+// are assigned priority classes, so that urgent transfers preempt background transfers sharing
+// the same bucket.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Type Priority specifies how urgently a transfer is to be served.
+type Priority int
+
+// The zero value of Priority is Normal.
+const (
+	Background    Priority = iota - 1 // served only if no other transfer is waiting
+	Normal                            // the default priority
+	Urgent                            // preempts all other transfers
+	numPriorities = 3
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Background:
+		return "background"
+	case Normal:
+		return "normal"
+	case Urgent:
+		return "urgent"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// Function ParsePriority returns the priority named by `s`, as returned by Priority.String().
+func ParsePriority(s string) (Priority, error) {
+	for p := Background; p <= Urgent; p++ {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return Normal, fmt.Errorf("invalid priority: %#v", s)
+}
+
+// Interface Limiter limits the rate at which bytes are transferred.
+type Limiter interface {
+	// Blocks until `n` bytes may be transferred at priority `p`. Returns ctx.Err() if `ctx` is
+	// done before.
+	Wait(ctx context.Context, p Priority, n int) error
+}
+
+// Struct Bucket implements Limiter using a token bucket. Tokens (bytes) are added at a
+// constant rate, up to a maximum burst size. Waiting transfers of higher priority are
+// served first. Create using NewBucket.
+type Bucket struct {
+	mutex   sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64 // maximum number of tokens
+	tokens  float64 // currently available tokens
+	last    time.Time
+	waiters [numPriorities]int // number of waiting transfers per priority, indexed by priority+1
+	changed chan struct{}      // closed and replaced whenever waiting transfers need to re-check
+}
+
+// Function NewBucket creates a token bucket that allows `rate` bytes per second on average
+// and bursts of up to `burst` bytes.
+func NewBucket(rate, burst int64) *Bucket {
+	if rate <= 0 || burst <= 0 {
+		panic("rate and burst must be positive")
+	}
+	return &Bucket{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Changes the rate of the bucket. Waiting transfers are affected as well.
+func (b *Bucket) SetRate(rate int64) {
+	if rate <= 0 {
+		panic("rate must be positive")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	b.notify()
+}
+
+// Returns the current rate of the bucket in bytes per second.
+func (b *Bucket) Rate() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return int64(b.rate)
+}
+
+// Adds tokens accumulated since the last refill. Must be called while holding the mutex.
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Returns true if transfers of a higher priority than `p` are waiting. Must be called while
+// holding the mutex.
+func (b *Bucket) preempted(p Priority) bool {
+	for q := p + 1; q <= Urgent; q++ {
+		if b.waiters[q+1] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Wakes up all waiting transfers. Must be called while holding the mutex.
+func (b *Bucket) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *Bucket) Wait(ctx context.Context, p Priority, n int) error {
+	if p < Background {
+		p = Background
+	} else if p > Urgent {
+		p = Urgent
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.waiters[p+1]++
+	defer func() {
+		// Transfers preempted by the last waiting transfer of this priority may proceed
+		if b.waiters[p+1]--; b.waiters[p+1] == 0 {
+			b.notify()
+		}
+	}()
+
+	for remaining := float64(n); remaining > 0; {
+		// Requests exceeding the burst size are served in pieces
+		need := remaining
+		if need > b.burst {
+			need = b.burst
+		}
+		b.refill(time.Now())
+		preempted := b.preempted(p)
+		if !preempted && b.tokens >= need {
+			b.tokens -= need
+			remaining -= need
+			continue
+		}
+
+		// Wait until enough tokens will have accumulated, or until preempting transfers are
+		// done or the rate changes.
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !preempted {
+			timer = time.NewTimer(time.Duration((need - b.tokens) / b.rate * float64(time.Second)))
+			timeout = timer.C
+		}
+		changed := b.changed
+		b.mutex.Unlock()
+		select {
+		case <-timeout:
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		b.mutex.Lock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function Chain returns a Limiter that waits for all given limiters in turn, e.g. for a
+// per-transfer limit and a global limit. Nil limiters are ignored.
+func Chain(limiters ...Limiter) Limiter {
+	var result chain
+	for _, l := range limiters {
+		if l != nil {
+			result = append(result, l)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	} else if len(result) == 1 {
+		return result[0]
+	}
+	return result
+}
+
+type chain []Limiter
+
+func (c chain) Wait(ctx context.Context, p Priority, n int) error {
+	for _, l := range c {
+		if err := l.Wait(ctx, p, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Struct Writer is an io.Writer that limits the rate at which data is written to W. If Context is
+// not nil, writing fails as soon as it is done.
+type Writer struct {
+	W        io.Writer
+	Limiter  Limiter
+	Priority Priority
+	Context  context.Context
+}
+
+func (w Writer) Write(p []byte) (n int, err error) {
+	if w.Limiter != nil {
+		if err := w.Limiter.Wait(contextOrBackground(w.Context), w.Priority, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return w.W.Write(p)
+}
+
+// Struct Reader is an io.Reader that limits the rate at which data is read from R. If Context is
+// not nil, reading fails as soon as it is done.
+type Reader struct {
+	R        io.Reader
+	Limiter  Limiter
+	Priority Priority
+	Context  context.Context
+}
+
+func (r Reader) Read(p []byte) (n int, err error) {
+	n, err = r.R.Read(p)
+	if r.Limiter != nil && n > 0 {
+		if werr := r.Limiter.Wait(contextOrBackground(r.Context), r.Priority, n); werr != nil {
+			return n, werr
+		}
+	}
+	return
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketRate(t *testing.T) {
+	const rate = 1 << 20
+	b := NewBucket(rate, 16<<10)
+	w := Writer{W: ioutil.Discard, Limiter: b}
+	data := make([]byte, 4<<10)
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	// 256KB at 1MB/s, minus the initial burst of 16KB, takes at least 234ms
+	elapsed := time.Since(start)
+	t.Logf("Writing took %v", elapsed)
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Unexpected duration: %v", elapsed)
+	}
+}
+
+func TestBucketLargeRequest(t *testing.T) {
+	b := NewBucket(1<<20, 1<<10)
+	r := Reader{R: bytes.NewReader(make([]byte, 100<<10)), Limiter: b}
+	start := time.Now()
+	if n, err := ioutil.ReadAll(r); err != nil || len(n) != 100<<10 {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Reading too fast: %v", elapsed)
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	b := NewBucket(100<<10, 1<<10)
+	// Drain the bucket
+	_ = b.Wait(context.Background(), Normal, 1<<10)
+
+	var mutex sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	for _, p := range []Priority{Background, Normal, Urgent} {
+		wg.Add(1)
+		go func(p Priority) {
+			defer wg.Done()
+			_ = b.Wait(context.Background(), p, 10<<10)
+			mutex.Lock()
+			order = append(order, p)
+			mutex.Unlock()
+		}(p)
+		// Make sure that lower priorities start waiting first
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if len(order) != 3 || order[0] != Urgent || order[1] != Normal || order[2] != Background {
+		t.Errorf("Unexpected order of completion: %v", order)
+	}
+}
+
+func TestCancelWait(t *testing.T) {
+	b := NewBucket(1<<10, 1<<10)
+	_ = b.Wait(context.Background(), Normal, 1<<10)
+
+	// Keep a background transfer preempted by an urgent one that waits for a long time
+	urgent, cancelUrgent := context.WithCancel(context.Background())
+	defer cancelUrgent()
+	go func() { _ = b.Wait(urgent, Urgent, 1<<20) }()
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Wait(ctx, Background, 1); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Cancellation took too long: %v", elapsed)
+	}
+
+	// Once the urgent transfer gives up, the background transfer proceeds
+	done := make(chan error)
+	go func() { done <- b.Wait(context.Background(), Background, 1) }()
+	time.Sleep(5 * time.Millisecond)
+	cancelUrgent()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error waiting: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Background transfer not woken up")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{Background, Normal, Urgent} {
+		if q, err := ParsePriority(p.String()); err != nil || q != p {
+			t.Errorf("Error parsing %v: %v %v", p, q, err)
+		}
+	}
+	if _, err := ParsePriority("whenever"); err == nil {
+		t.Errorf("Expected error")
+	}
+	var p Priority
+	if p != Normal {
+		t.Errorf("Zero value must be Normal")
+	}
+}
@@ -18,13 +18,18 @@ package remotesync
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
 	"log"
+	"math"
 	"sync"
+	"time"
 )
 
 var ErrDisposed = errors.New("disposed")
@@ -45,23 +50,159 @@ type Builder struct {
 	memos   chan memo
 	info    string
 	syncinf *SyncInfo
-
-	mutex    sync.Mutex // Guards subsequent variables
-	disposed bool       // Set in Dispose
-	started  bool       // Set in WriteWishList. Signals that chunks channel will be used.
+	enc     WishlistEncoding
+	limiter ratelimit.Limiter
+	prio    ratelimit.Priority
+	ctx     context.Context // If not nil, aborts waiting for the limiter when done
+	tracker transferTracker
+	budget  *MemoryBudget // If not nil, the footprint is reserved from this budget
+	adapt   bool          // Whether the window may be shrunk to make the footprint fit
+	taken   chan struct{} // Signalled whenever a memo has been taken from the memos channel
+
+	mutex       sync.Mutex // Guards subsequent variables
+	disposed    bool       // Set in Dispose
+	started     bool       // Set in WriteWishList. Signals that chunks channel will be used.
+	reserved    bool       // Set in Reserve
+	window      int        // The number of memos that may be pending. Valid when reserved.
+	reservation int64      // The number of bytes reserved from the budget
 }
 
 // Returns a new Builder for reconstructing a file. Must eventually be disposed.
 // The builder can then proceed sending a "wishlist" of chunks that are missing
 // in the local storage for complete reconstruction of the file.
 func NewBuilder(storage cafs.FileStorage, syncinf *SyncInfo, windowSize int, info string) *Builder {
-	return &Builder{
+	b := &Builder{
 		done:    make(chan struct{}),
 		storage: storage,
 		memos:   make(chan memo, windowSize),
 		info:    info,
 		syncinf: syncinf,
+		taken:   make(chan struct{}, 1),
+		window:  windowSize,
+	}
+	for _, ci := range syncinf.Chunks {
+		if ci != emptyChunkInfo {
+			b.tracker.stats.ChunksTotal++
+			b.tracker.stats.BytesTotal += int64(ci.Size)
+		}
+	}
+	return b
+}
+
+// Sets the encoding used by WriteWishList. Must be called before WriteWishList. The sender must be
+// configured to expect the same encoding.
+func (b *Builder) WithWishlistEncoding(enc WishlistEncoding) *Builder {
+	b.enc = enc
+	return b
+}
+
+// Limits the rate at which chunk data is read by ReconstructFileFromRequestedChunks. Must be
+// called before reading chunk data.
+func (b *Builder) WithLimiter(limiter ratelimit.Limiter, prio ratelimit.Priority) *Builder {
+	b.limiter = limiter
+	b.prio = prio
+	return b
+}
+
+// Aborts waiting for the limiter as soon as `ctx` is done. Must be called before reading chunk
+// data.
+func (b *Builder) WithContext(ctx context.Context) *Builder {
+	b.ctx = ctx
+	return b
+}
+
+// Sets an observer to be notified about the progress of the transmission. Must be called before
+// WriteWishList. The observer is called from the goroutines running WriteWishList and
+// ReconstructFileFromRequestedChunks, but never concurrently.
+func (b *Builder) WithObserver(observer TransferObserver) *Builder {
+	b.tracker.observer = observer
+	return b
+}
+
+// Sets a memory budget from which the Builder reserves its worst-case footprint of locked bytes,
+// see Reserve. If `adaptive` is true, the Builder shrinks its window if necessary to make the
+// footprint fit, down to a minimum depending on the wishlist encoding. Must be called before Reserve
+// and WriteWishList.
+func (b *Builder) WithMemoryBudget(budget *MemoryBudget, adaptive bool) *Builder {
+	b.budget = budget
+	b.adapt = adaptive
+	return b
+}
+
+// Computes the worst-case number of bytes the Builder keeps locked in storage, which depends on the
+// chunk sizes, the window size and the length of the permutation, and makes sure they are available:
+// They are reserved from the memory budget, if one was set. If the storage is a cafs.BoundedStorage,
+// they must not exceed its unlocked capacity. Bytes locked by the reconstructed file itself are not
+// included.
+//
+// Fails with an error wrapping cafs.ErrNotEnoughSpace if the footprint doesn't fit, even with the
+// smallest window in case of an adaptive window. Called by WriteWishList, but may be called earlier
+// in order to fail before contacting the sender. Calling it again has no effect.
+func (b *Builder) Reserve() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.disposed {
+		return ErrDisposed
+	}
+	if b.reserved {
+		return nil
+	}
+
+	fp := newFootprint(b.syncinf)
+	fit := func(available int64) (int64, error) {
+		if capacity := unlockedCapacity(b.storage); capacity < available {
+			available = capacity
+		}
+		window := b.window
+		if b.adapt && fp.forWindow(window) > available {
+			if w := fp.fittingWindow(minWindow(b.enc), window, available); w > 0 {
+				window = w
+			}
+		}
+		if fp.forWindow(window) > available {
+			return 0, fmt.Errorf("%w: building %v requires up to %d bytes of locked storage, only %d available",
+				cafs.ErrNotEnoughSpace, b.info, fp.forWindow(b.window), available)
+		}
+		b.window = window
+		return fp.forWindow(window), nil
+	}
+
+	var err error
+	if b.budget != nil {
+		b.reservation, err = b.budget.reserveFitting(fit)
+	} else {
+		_, err = fit(math.MaxInt64)
+	}
+	if err != nil {
+		return err
+	}
+	if LoggingEnabled {
+		log.Printf("Receiver: Reserved %d bytes for %v with a window of %d", fp.forWindow(b.window), b.info, b.window)
 	}
+	b.reserved = true
+	return nil
+}
+
+// Returns the number of memos that may be pending between writing the wishlist and receiving chunk
+// data. May be smaller than the window size requested in NewBuilder after Reserve.
+func (b *Builder) Window() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.window
+}
+
+// Returns the current statistics of the transmission.
+func (b *Builder) Stats() TransferStats {
+	return b.tracker.snapshot()
+}
+
+// Marks the transmission as started, if not done already.
+func (b *Builder) markStarted() {
+	b.tracker.update(func(stats *TransferStats) {
+		if stats.Started.IsZero() {
+			stats.Started = time.Now()
+		}
+	})
 }
 
 // Disposes the Builder. Must be called exactly once per Builder. May cause the goroutines running
@@ -77,6 +218,11 @@ func (b *Builder) Dispose() {
 
 	close(b.done)
 
+	if b.budget != nil && b.reservation > 0 {
+		b.budget.Release(b.reservation)
+		b.reservation = 0
+	}
+
 	if started {
 		for chunk := range b.memos {
 			if chunk.file != nil {
@@ -88,23 +234,31 @@ func (b *Builder) Dispose() {
 
 // Outputs a bit stream with '1' for each missing chunk, and
 // '0' for each chunk that is already available or already requested.
+// The writer is flushed only when waiting for chunk data and at the end.
 func (b *Builder) WriteWishList(w FlushWriter) error {
 	if LoggingEnabled {
 		log.Printf("Receiver: Begin WriteWishList")
 		defer log.Printf("Receiver: End WriteWishList")
 	}
 
+	if err := b.Reserve(); err != nil {
+		return err
+	}
 	if err := b.start(); err != nil {
 		return err
 	}
+	b.markStarted()
 
 	defer close(b.memos)
 
 	requested := make(map[cafs.SKey]bool)
-	bitWriter := newBitWriter(w)
+	wishlist := newWishlistWriter(b.enc, w)
 
-	consumeFunc := func(v interface{}) error {
-		ci := v.(ChunkInfo)
+	consumeFunc := func(v shuffle.Slot[ChunkInfo]) error {
+		ci := emptyChunkInfo
+		if v.Ok {
+			ci = v.Value
+		}
 		key := ci.Key
 
 		mem := memo{
@@ -125,21 +279,42 @@ func (b *Builder) WriteWishList(w FlushWriter) error {
 			requested[key] = true
 		}
 
-		// Write memo into channel. This might block if channel buffer is full.
-		// Only wait until disposed.
+		// Write memo into channel. This might block if the window is full, in which case
+		// the sender must learn about all chunks requested so far. Only wait until disposed.
+		if err := b.waitForWindow(wishlist); err != nil {
+			if mem.file != nil {
+				mem.file.Dispose()
+			}
+			return err
+		}
 		select {
 		case b.memos <- mem:
 			// Responsibility for disposing chunk.file is passed to the channel
-		case <-b.done:
-			if mem.file != nil {
-				mem.file.Dispose()
+		default:
+			if err := wishlist.Flush(); err != nil {
+				if mem.file != nil {
+					mem.file.Dispose()
+				}
+				return err
+			}
+			select {
+			case b.memos <- mem:
+			case <-b.done:
+				if mem.file != nil {
+					mem.file.Dispose()
+				}
+				return ErrDisposed
 			}
-			return ErrDisposed
 		}
 
-		if err := bitWriter.WriteBit(mem.requested); err != nil {
+		if err := wishlist.WriteBit(mem.requested); err != nil {
 			return err
 		}
+		if ci != emptyChunkInfo {
+			b.tracker.update(func(stats *TransferStats) {
+				stats.addChunk(int64(ci.Size), mem.requested)
+			})
+		}
 
 		return nil // success
 	}
@@ -147,17 +322,24 @@ func (b *Builder) WriteWishList(w FlushWriter) error {
 	// Create a shuffler using the above consumeFunc and push the SyncInfo's chunk infos through it.
 	// For every ChunkInfo leaving the shuffler (in shuffled order), the consumeFunc
 	// writes a bit into the wishlist.
-	shuffler := shuffle.NewStreamShuffler(b.syncinf.Perm, emptyChunkInfo, consumeFunc)
+	// Blank space inserted by the shuffler is represented by emptyChunkInfo.
+	shuffler := shuffle.NewStreamShufflerOf(b.syncinf.Perm, consumeFunc)
 	nChunks := len(b.syncinf.Chunks)
 	for idx := 0; idx < nChunks; idx++ {
-		if err := shuffler.Put(b.syncinf.Chunks[idx]); err != nil {
+		if err := shuffler.Put(shuffle.Some(b.syncinf.Chunks[idx])); err != nil {
 			return fmt.Errorf("error from shuffler.Put: %v", err)
 		}
 	}
 	if err := shuffler.End(); err != nil {
 		return fmt.Errorf("error from shuffler.End: %v", err)
 	}
-	return bitWriter.Flush()
+	if err := wishlist.Close(); err != nil {
+		return err
+	}
+	b.tracker.update(func(stats *TransferStats) {
+		stats.WishlistDone = time.Now()
+	})
+	return nil
 }
 
 // Function start is called by WriteWishList to mark the Builder as started.
@@ -175,12 +357,31 @@ func (b *Builder) start() error {
 	return nil
 }
 
-var placeholder interface{} = struct{}{}
+// Function waitForWindow is called by WriteWishList before writing a memo. If the window has been
+// shrunk by Reserve, the memos channel has more capacity than allowed. In that case, it flushes the
+// wishlist and waits until the number of pending memos falls below the window.
+func (b *Builder) waitForWindow(wishlist wishlistWriter) error {
+	if b.window >= cap(b.memos) || len(b.memos) < b.window {
+		return nil
+	}
+	if err := wishlist.Flush(); err != nil {
+		return err
+	}
+	for len(b.memos) >= b.window {
+		select {
+		case <-b.taken:
+		case <-b.done:
+			return ErrDisposed
+		}
+	}
+	return nil
+}
+
 var zeroMemo = memo{}
 
 // Reads a sequence of length-prefixed data chunks and tries to reconstruct a file from that
 // information.
-func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, error) {
+func (b *Builder) ReconstructFileFromRequestedChunks(r io.Reader) (cafs.File, error) {
 	if LoggingEnabled {
 		log.Printf("Receiver: Begin ReconstructFileFromRequestedChunks")
 		defer log.Printf("Receiver: End ReconstructFileFromRequestedChunks")
@@ -189,23 +390,82 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 	temp := b.storage.Create(b.info)
 	defer temp.Dispose()
 
+	if err := b.reconstruct(r, func(chunk cafs.File) error {
+		// Write a chunk of the work file
+		return appendChunk(temp, chunk)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+
+	file := temp.File()
+	if err := b.syncinf.Verify(file.Key(), file.Size()); err != nil {
+		file.Dispose()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Reads a sequence of length-prefixed data chunks and returns a reader yielding the reconstructed
+// file's bytes in order as soon as they become available, i.e. while the transmission is still going
+// on. Reading blocks only while the next chunk is missing. Errors occurring during reconstruction are
+// returned by Read. The returned reader must be closed. Closing it before reaching EOF aborts the
+// reconstruction. The file is not stored as a whole, but received chunks remain in storage as long as
+// they are referenced otherwise.
+func (b *Builder) StreamFileFromRequestedChunks(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		if LoggingEnabled {
+			log.Printf("Receiver: Begin StreamFileFromRequestedChunks")
+			defer log.Printf("Receiver: End StreamFileFromRequestedChunks")
+		}
+		// The file key is the SHA256 of the file's contents, see Handshake.Hash
+		hash := sha256.New()
+		var size int64
+		err := b.reconstruct(r, func(chunk cafs.File) error {
+			size += chunk.Size()
+			// Blocks until the reader has consumed the chunk's data
+			return appendChunk(io.MultiWriter(hash, pw), chunk)
+		})
+		if err == nil {
+			var key cafs.SKey
+			hash.Sum(key[:0])
+			err = b.syncinf.Verify(key, size)
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Reads a sequence of length-prefixed data chunks and passes all chunks of the file, in original order,
+// to function `consume`. The chunks passed are disposed after `consume` returns.
+func (b *Builder) reconstruct(_r io.Reader, consume func(chunk cafs.File) error) error {
+	b.markStarted()
+	defer b.tracker.update(func(stats *TransferStats) {
+		stats.Finished = time.Now()
+	})
+
+	if b.limiter != nil {
+		_r = ratelimit.Reader{R: _r, Limiter: b.limiter, Priority: b.prio, Context: b.ctx}
+	}
 	r := bufio.NewReader(_r)
 
 	errDone := errors.New("done")
 
-	unshuffler := shuffle.NewInverseStreamShuffler(b.syncinf.Perm, placeholder, func(v interface{}) error {
-		chunk := v.(cafs.File)
-		// Write a chunk of the work file
-		err := appendChunk(temp, chunk)
+	unshuffler := shuffle.NewInverseStreamShufflerOf(b.syncinf.Perm, shuffle.SkipEmpty(func(chunk cafs.File) error {
+		err := consume(chunk)
 		chunk.Dispose()
 		return err
-	})
+	}))
 
 	// Make sure all chunks in the unshuffler are disposed in the end
-	defer unshuffler.WithFunc(func(v interface{}) error {
-		v.(cafs.File).Dispose()
+	defer unshuffler.WithFunc(shuffle.SkipEmpty(func(chunk cafs.File) error {
+		chunk.Dispose()
 		return nil
-	}).End()
+	})).End()
 
 	idx := 0
 	iteration := func() error {
@@ -219,6 +479,10 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 		case mem = <-b.memos:
 			// successfully read, continue...
 		}
+		select {
+		case b.taken <- struct{}{}:
+		default:
+		}
 
 		// It is our responsibility to dispose the file.
 		if mem.file != nil {
@@ -226,7 +490,7 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 		}
 
 		if mem.ci == emptyChunkInfo {
-			return unshuffler.Put(placeholder)
+			return unshuffler.Put(shuffle.None[cafs.File]())
 		}
 
 		// Under the following circumstances, read chunk data from the stream.
@@ -251,6 +515,9 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 			} else if chunkFile.Size() != int64(mem.ci.Size) {
 				return ErrUnexpectedChunk
 			}
+			b.tracker.update(func(stats *TransferStats) {
+				stats.addTransferred(chunkFile.Size())
+			})
 		}
 
 		// Retrieve the chunk from CAFS (we can expect to find it)
@@ -260,27 +527,19 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 		if LoggingEnabled {
 			log.Printf("Receiver: unshuffler.Put(total:%v, %v)", chunk.Size(), chunk.Key())
 		}
-		return unshuffler.Put(chunk)
+		return unshuffler.Put(shuffle.Some(chunk))
 	}
 
 	for {
 		if err := iteration(); err == errDone {
 			break
 		} else if err != nil {
-			return nil, err
+			return err
 		}
 		idx++
 	}
 
-	if err := unshuffler.End(); err != nil {
-		return nil, err
-	}
-
-	if err := temp.Close(); err != nil {
-		return nil, err
-	}
-
-	return temp.File(), nil
+	return unshuffler.End()
 }
 
 // Function appendChunk appends data of `chunk` to `temp`.
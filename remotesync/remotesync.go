@@ -16,6 +16,7 @@
 
 // Package remotesync implements a differential file synching mechanism based on the content-based chunking
 // that is used by CAFS internally.
+// Step 0: Sender and receiver exchange handshakes and agree on a protocol version
 // Step 1: Sender and receiver agree on hashes of the file's chunks
 // Step 2: Receiver streams missing chunks (one bit per chunk)
 // Step 3: Sender responds by sending content of requested chunks
@@ -2,11 +2,14 @@ package remotesync
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	. "github.com/indyjo/cafs/ram"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 )
@@ -44,21 +47,57 @@ func TestRemoteSync(t *testing.T) {
 				func() {
 					defer reportUsage(t, "B", storeB)
 					defer reportUsage(t, "A", storeA)
-					testWithParams(t, storeA, storeB, p, sigma, nBlocks, perm)
+					testWithParams(t, storeA, storeB, p, sigma, nBlocks, perm, BitWishlist, 0)
 				}()
 			}
 		}
 	}
 }
 
+func TestRemoteSyncRunLength(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	for _, p := range []float64{0, 0.5, 0.99, 1} {
+		for _, nBlocks := range []int{0, 1, 16, 256} {
+			for _, permSize := range []int{1, 10, 1000} {
+				perm := shuffle.Permutation(rand.Perm(permSize))
+				func() {
+					defer reportUsage(t, "B", storeB)
+					defer reportUsage(t, "A", storeA)
+					testWithParams(t, storeA, storeB, p, 0.25, nBlocks, perm, RunLengthWishlist, 0)
+				}()
+			}
+		}
+	}
+}
+
+func TestRemoteSyncReadAhead(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	for _, enc := range []WishlistEncoding{BitWishlist, RunLengthWishlist} {
+		for _, readAhead := range []int{1, 4, 100} {
+			for _, p := range []float64{0, 0.5, 1} {
+				for _, permSize := range []int{1, 10, 1000} {
+					perm := shuffle.Permutation(rand.Perm(permSize))
+					func() {
+						defer reportUsage(t, "B", storeB)
+						defer reportUsage(t, "A", storeA)
+						testWithParams(t, storeA, storeB, p, 0.25, 128, perm, enc, readAhead)
+					}()
+				}
+			}
+		}
+	}
+}
+
 func check(t *testing.T, msg string, err error) {
 	if err != nil {
 		t.Fatalf("Error %v: %v", msg, err)
 	}
 }
 
-func testWithParams(t *testing.T, storeA, storeB cafs.BoundedStorage, p, sigma float64, nBlocks int, perm shuffle.Permutation) {
-	t.Logf("Testing with params: p=%f, nBlocks=%d, permSize=%d", p, nBlocks, len(perm))
+func testWithParams(t *testing.T, storeA, storeB cafs.BoundedStorage, p, sigma float64, nBlocks int, perm shuffle.Permutation, enc WishlistEncoding, readAhead int) {
+	t.Logf("Testing with params: p=%f, nBlocks=%d, permSize=%d, encoding=%v, readAhead=%d", p, nBlocks, len(perm), enc, readAhead)
 	tempA := storeA.Create(fmt.Sprintf("Data A(%.2f,%d)", p, nBlocks))
 	defer tempA.Dispose()
 	tempB := storeB.Create(fmt.Sprintf("Data B(%.2f,%d)", p, nBlocks))
@@ -75,7 +114,7 @@ func testWithParams(t *testing.T, storeA, storeB cafs.BoundedStorage, p, sigma f
 	syncinf := &SyncInfo{}
 	syncinf.SetPermutation(perm)
 	syncinf.SetChunksFromFile(fileA)
-	builder := NewBuilder(storeB, syncinf, 8, fmt.Sprintf("Recovered A(%.2f,%d)", p, nBlocks))
+	builder := NewBuilder(storeB, syncinf, 8, fmt.Sprintf("Recovered A(%.2f,%d)", p, nBlocks)).WithWishlistEncoding(enc)
 	defer builder.Dispose()
 
 	// task: transfer file A to storage B
@@ -95,7 +134,8 @@ func testWithParams(t *testing.T, storeA, storeB cafs.BoundedStorage, p, sigma f
 	go func() {
 		chunks := ChunksOfFile(fileA)
 		defer chunks.Dispose()
-		if err := WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil); err != nil {
+		sender := Sender{Encoding: enc, ReadAhead: readAhead}
+		if err := sender.WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil); err != nil {
 			_ = pipeWriter2.CloseWithError(fmt.Errorf("Error sending requested chunk data: %v", err))
 		} else {
 			_ = pipeWriter2.Close()
@@ -194,3 +234,112 @@ func reportUsage(t *testing.T, name string, store cafs.BoundedStorage) {
 		t.FailNow()
 	}
 }
+
+// Struct gateWriter passes the first `n` bytes written and then blocks until `open` is closed.
+type gateWriter struct {
+	w    io.Writer
+	n    int
+	open chan struct{}
+}
+
+func (g *gateWriter) Write(p []byte) (int, error) {
+	if len(p) > g.n {
+		<-g.open
+		g.n = len(p)
+	}
+	g.n -= len(p)
+	return g.w.Write(p)
+}
+
+func TestStreamFile(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	data := randomBytes(1024 * 1024)
+	fileA := addFile(t, storeA, data)
+	defer fileA.Dispose()
+
+	// Use the identity permutation, so that the first chunk is released by the unshuffler right away
+	perm := shuffle.Permutation{0}
+	syncinf := &SyncInfo{Perm: perm}
+	syncinf.SetChunksFromFile(fileA)
+	builder := NewBuilder(storeB, syncinf, 8, "streamed")
+	defer builder.Dispose()
+
+	pipeReader1, pipeWriter1 := io.Pipe()
+	pipeReader2, pipeWriter2 := io.Pipe()
+	go func() {
+		_ = pipeWriter1.CloseWithError(builder.WriteWishList(NopFlushWriter{pipeWriter1}))
+	}()
+
+	// The sender stalls after transmitting half of the data
+	gate := &gateWriter{w: pipeWriter2, n: len(data) / 2, open: make(chan struct{})}
+	go func() {
+		chunks := ChunksOfFile(fileA)
+		defer chunks.Dispose()
+		_ = pipeWriter2.CloseWithError(WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{gate}, nil))
+	}()
+
+	stream := builder.StreamFileFromRequestedChunks(pipeReader2)
+	defer stream.Close()
+
+	// Some data must be available while the sender is stalled
+	head := make([]byte, 1024)
+	if _, err := io.ReadFull(stream, head); err != nil {
+		t.Fatalf("Error reading head of stream: %v", err)
+	}
+	close(gate.open)
+	tail, err := ioutil.ReadAll(stream)
+	check(t, "reading tail of stream", err)
+	if !bytes.Equal(append(head, tail...), data) {
+		t.Fatalf("Streamed data differs")
+	}
+}
+
+func TestFileMismatch(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	fileA := addFile(t, storeA, randomBytes(256*1024))
+	defer fileA.Dispose()
+
+	// The sender advertises a different file than it sends
+	perm := shuffle.Permutation{1, 0}
+	syncinf := &SyncInfo{Perm: perm}
+	syncinf.SetChunksFromFile(fileA)
+	wrongKey := cafs.SKey{1, 2, 3}
+	syncinf.Key = &wrongKey
+
+	transfer := func(builder *Builder) io.Reader {
+		pipeReader1, pipeWriter1 := io.Pipe()
+		pipeReader2, pipeWriter2 := io.Pipe()
+		go func() {
+			_ = pipeWriter1.CloseWithError(builder.WriteWishList(NopFlushWriter{pipeWriter1}))
+		}()
+		go func() {
+			chunks := ChunksOfFile(fileA)
+			defer chunks.Dispose()
+			_ = pipeWriter2.CloseWithError(WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil))
+		}()
+		return pipeReader2
+	}
+
+	var mismatch *FileMismatchError
+	builder := NewBuilder(storeB, syncinf, 8, "mismatch")
+	file, err := builder.ReconstructFileFromRequestedChunks(transfer(builder))
+	builder.Dispose()
+	if !errors.As(err, &mismatch) || mismatch.Key != fileA.Key() || mismatch.ExpectedKey != wrongKey {
+		t.Fatalf("Expected FileMismatchError, got file %v and error %v", file, err)
+	}
+	reportUsage(t, "B", storeB)
+
+	builder = NewBuilder(storeB, syncinf, 8, "mismatch (streamed)")
+	stream := builder.StreamFileFromRequestedChunks(transfer(builder))
+	_, err = ioutil.ReadAll(stream)
+	_ = stream.Close()
+	builder.Dispose()
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected FileMismatchError from stream, got %v", err)
+	}
+}
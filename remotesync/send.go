@@ -17,16 +17,22 @@
 package remotesync
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
+	"io/ioutil"
 	"log"
+	"time"
 )
 
 // By passing a callback function to some of the transmissions functions,
 // the caller may subscribe to the current transmission status.
+//
+// Deprecated: Use a TransferObserver, which receives more detailed statistics.
 type TransferStatusCallback func(bytesToTransfer, bytesTransferred int64)
 
 // Interface Chunks allows iterating over any sequence of chunks.
@@ -68,12 +74,12 @@ func (c chunksOfFile) Dispose() {
 // Iterates over a wishlist (read from `r` and pertaining to a permuted order of hashes),
 // and calls `f` for each chunk of `file`, requested or not.
 // If `f` returns an error, aborts the iteration and also returns the error.
-func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f func(chunk cafs.File, requested bool) error) error {
-	bits := newBitReader(r)
+func forEachChunk(chunks Chunks, r io.ByteReader, enc WishlistEncoding, perm shuffle.Permutation, f func(chunk cafs.File, requested bool) error) error {
+	bits := newWishlistReader(enc, r)
 
 	// Prepare shuffler for iterating the file's chunks in shuffled order, matching them with
 	// whishlist bits and calling `f` for each chunk, requested or not.
-	shuffler := shuffle.NewStreamShuffler(perm, nil, func(v interface{}) error {
+	shuffler := shuffle.NewStreamShufflerOf(perm, func(v shuffle.Slot[cafs.File]) error {
 		var requested bool
 		if b, err := bits.ReadBit(); err != nil {
 			return fmt.Errorf("error reading from wishlist bitstream: %v", err)
@@ -81,7 +87,7 @@ func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f fu
 			requested = b
 		}
 
-		if v == nil {
+		if !v.Ok {
 			// This is a placeholder key generated by the shuffler. Require that the receiver
 			// signalled not to request the corresponding chunk.
 			if requested {
@@ -92,7 +98,7 @@ func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f fu
 		}
 
 		// We have a chunk with a corresponding wishlist bit. Dispatch to delegate function.
-		chunk := v.(cafs.File)
+		chunk := v.Value
 		err := f(chunk, requested)
 		chunk.Dispose()
 		return err
@@ -101,19 +107,17 @@ func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f fu
 	// At the end of this function, we must make sure that all chunks still stored
 	// in the shuffler are disposed of.
 	defer func() {
-		s := shuffler.WithFunc(func(v interface{}) error {
-			if v != nil {
-				v.(cafs.File).Dispose()
-			}
+		s := shuffler.WithFunc(shuffle.SkipEmpty(func(chunk cafs.File) error {
+			chunk.Dispose()
 			return nil
-		})
+		}))
 		_ = s.End()
 	}()
 
 	// Iterate through the chunks and put their keys into the shuffler.
 	for {
 		if chunk, err := chunks.NextChunk(); err == nil {
-			if err := shuffler.Put(chunk); err != nil {
+			if err := shuffler.Put(shuffle.Some(chunk)); err != nil {
 				return err
 			}
 		} else if err == io.EOF {
@@ -128,53 +132,208 @@ func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f fu
 	}
 
 	// Expect whishlist byte stream to be read completely
-	if _, err := r.ReadByte(); err != io.EOF {
-		return errors.New("wishlist too long")
-	}
-	return nil
+	return bits.End()
+}
+
+// Struct Sender holds settings for transmitting chunk data. The zero value is ready to use and
+// speaks the legacy protocol.
+type Sender struct {
+	// The encoding of the wishlist read from the receiver.
+	Encoding WishlistEncoding
+	// If not nil, limits the rate at which chunk data is written.
+	Limiter ratelimit.Limiter
+	// The priority at which to wait for the Limiter.
+	Priority ratelimit.Priority
+	// If not nil, waiting for the Limiter is aborted as soon as the context is done.
+	Context context.Context
+	// If not nil, notified about the progress of each transmission.
+	Observer TransferObserver
+	// The number of requested chunks to read concurrently ahead of the chunk being written. Useful
+	// with storages having a high access latency. If zero, chunks are read one after the other.
+	ReadAhead int
 }
 
+// A reasonable value for Sender.ReadAhead.
+const DefaultReadAhead = 8
+
 // Writes a stream of chunk length / data pairs, permuted by a shuffler corresponding to `perm`,
 // into an io.Writer, based on the chunks of a file and a matching permuted wishlist of requested chunks,
-// read from `r`.
+// read from `r`. Uses the default Sender settings.
 func WriteChunkData(chunks Chunks, bytesToTransfer int64, r io.ByteReader, perm shuffle.Permutation, w FlushWriter, cb TransferStatusCallback) error {
+	var s Sender
+	return s.WriteChunkData(chunks, bytesToTransfer, r, perm, w, cb)
+}
+
+// Writes a stream of chunk length / data pairs, permuted by a shuffler corresponding to `perm`,
+// into an io.Writer, based on the chunks of a file and a matching permuted wishlist of requested chunks,
+// read from `r`.
+func (s *Sender) WriteChunkData(chunks Chunks, bytesToTransfer int64, r io.ByteReader, perm shuffle.Permutation, w FlushWriter, cb TransferStatusCallback) error {
 	if LoggingEnabled {
 		log.Printf("Sender: Begin WriteChunkData")
 		defer log.Printf("Sender: End WriteChunkData")
 	}
 
-	// Determine the number of bytes to transmit by starting at the maximum and subtracting chunk
-	// total whenever we read a 0 (chunk not requested)
+	if s.Limiter != nil {
+		w = limitedFlushWriter{w, ratelimit.Writer{W: w, Limiter: s.Limiter, Priority: s.Priority, Context: s.Context}}
+	}
+
+	// The callback learns about the number of bytes to transmit by starting at the maximum and
+	// subtracting chunk sizes whenever a chunk is not requested.
+	observer := s.Observer
 	if cb != nil {
-		cb(bytesToTransfer, 0)
+		observer = chainObservers(observer, TransferObserverFunc(func(stats TransferStats) {
+			cb(stats.BytesTotal-stats.BytesReused, stats.BytesTransferred)
+		}))
 	}
+	tracker := &transferTracker{observer: observer}
+	tracker.update(func(stats *TransferStats) {
+		stats.BytesTotal = bytesToTransfer
+		stats.Started = time.Now()
+	})
 
-	// Iterate requested chunks. Write the chunk's length (as varint) and the chunk data
-	// into the output writer. Update the number of bytes transferred on the go.
-	var bytesTransferred int64
-	return forEachChunk(chunks, r, perm, func(chunk cafs.File, requested bool) error {
-		if requested {
-			if err := writeVarint(w, chunk.Size()); err != nil {
-				return err
+	var err error
+	if s.ReadAhead > 0 {
+		err = s.writeReadAhead(chunks, r, perm, w, tracker)
+	} else {
+		err = s.writeSequentially(chunks, r, perm, w, tracker)
+	}
+
+	tracker.update(func(stats *TransferStats) {
+		stats.Finished = time.Now()
+		if err == nil {
+			stats.WishlistDone = stats.Finished
+		}
+	})
+	return err
+}
+
+// Calls forEachChunk, accounting for every chunk in the tracker and passing requested chunks to `send`.
+func (s *Sender) forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, tracker *transferTracker, send func(chunk cafs.File) error) error {
+	var bytesSeen int64
+	return forEachChunk(chunks, r, s.Encoding, perm, func(chunk cafs.File, requested bool) error {
+		// Empty files consist of the empty chunk, which the receiver never requests. Don't count it.
+		if chunk.Key() != emptyKey {
+			bytesSeen += chunk.Size()
+			tracker.update(func(stats *TransferStats) {
+				stats.ChunksTotal++
+				if bytesSeen > stats.BytesTotal {
+					stats.BytesTotal = bytesSeen
+				}
+				stats.addChunk(chunk.Size(), requested)
+			})
+		}
+		if !requested {
+			return nil
+		}
+		return send(chunk)
+	})
+}
+
+// Writes requested chunks one after the other, flushing after each chunk.
+func (s *Sender) writeSequentially(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, w FlushWriter, tracker *transferTracker) error {
+	return s.forEachChunk(chunks, r, perm, tracker, func(chunk cafs.File) error {
+		if err := writeVarint(w, chunk.Size()); err != nil {
+			return err
+		}
+		r := chunk.Open()
+		if n, err := io.Copy(w, r); err != nil {
+			_ = r.Close()
+			return err
+		} else {
+			w.Flush()
+			tracker.update(func(stats *TransferStats) {
+				stats.addTransferred(n)
+			})
+		}
+		return r.Close()
+	})
+}
+
+// Struct prefetch holds the data of a chunk being read in the background.
+type prefetch struct {
+	done chan struct{} // Closed when data and err are valid
+	data []byte
+	err  error
+}
+
+// Function startPrefetch starts reading a chunk's data in the background. Takes ownership of `chunk`.
+func startPrefetch(chunk cafs.File) *prefetch {
+	p := &prefetch{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		defer chunk.Dispose()
+		r := chunk.Open()
+		p.data, p.err = ioutil.ReadAll(r)
+		if err := r.Close(); p.err == nil {
+			p.err = err
+		}
+	}()
+	return p
+}
+
+var errWriterFailed = errors.New("writer failed")
+
+// Reads up to s.ReadAhead requested chunks concurrently while writing them in order. Flushes only
+// when no further chunk has been queued, which includes the case of waiting for the wishlist.
+func (s *Sender) writeReadAhead(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, w FlushWriter, tracker *transferTracker) error {
+	queue := make(chan *prefetch, s.ReadAhead)
+	failed := make(chan struct{})  // Closed by the writer on error
+	aborted := make(chan struct{}) // Closed by the reader on error
+	writerDone := make(chan error, 1)
+
+	go func() {
+		var err error
+		for p := range queue {
+			if err != nil {
+				continue
 			}
-			r := chunk.Open()
-			if n, err := io.Copy(w, r); err != nil {
-				_ = r.Close()
-				return err
-			} else {
-				w.Flush()
-				bytesTransferred += n
+			select {
+			case <-aborted:
+				err = errWriterFailed
+				continue
+			case <-p.done:
 			}
-			if err := r.Close(); err != nil {
-				return err
+			if err = p.err; err == nil {
+				err = writeVarint(w, int64(len(p.data)))
+			}
+			if err == nil {
+				_, err = w.Write(p.data)
+			}
+			if err != nil {
+				close(failed)
+				continue
+			}
+			tracker.update(func(stats *TransferStats) {
+				stats.addTransferred(int64(len(p.data)))
+			})
+			if len(queue) == 0 {
+				// The reader might be waiting for the wishlist, which in turn might wait for chunk data
+				w.Flush()
 			}
-		} else {
-			bytesToTransfer -= chunk.Size()
 		}
-		if cb != nil {
-			// Notify callback of status
-			cb(bytesToTransfer, bytesTransferred)
+		writerDone <- err
+	}()
+
+	err := s.forEachChunk(chunks, r, perm, tracker, func(chunk cafs.File) error {
+		select {
+		case <-failed:
+			return errWriterFailed
+		default:
+		}
+		p := startPrefetch(chunk.Duplicate())
+		select {
+		case queue <- p:
+			return nil
+		case <-failed:
+			return errWriterFailed
 		}
-		return nil
 	})
+	if err != nil {
+		close(aborted)
+	}
+	close(queue)
+	if writerErr := <-writerDone; writerErr != nil && writerErr != errWriterFailed {
+		return writerErr
+	}
+	return err
 }
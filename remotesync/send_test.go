@@ -0,0 +1,137 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+// Struct slowFile simulates a file stored in a storage with high access latency.
+type slowFile struct {
+	cafs.File
+	latency time.Duration
+}
+
+func (f slowFile) Open() io.ReadCloser {
+	time.Sleep(f.latency)
+	return f.File.Open()
+}
+
+func (f slowFile) Duplicate() cafs.File {
+	return slowFile{f.File.Duplicate(), f.latency}
+}
+
+// Struct slowChunks returns the chunks of a file as slowFiles.
+type slowChunks struct {
+	Chunks
+	latency time.Duration
+}
+
+func (c slowChunks) NextChunk() (cafs.File, error) {
+	f, err := c.Chunks.NextChunk()
+	if err != nil {
+		return nil, err
+	}
+	return slowFile{f, c.latency}, nil
+}
+
+// Struct countingFlusher counts flushes of a FlushWriter.
+type countingFlusher struct {
+	FlushWriter
+	flushes int
+}
+
+func (c *countingFlusher) Flush() {
+	c.flushes++
+	c.FlushWriter.Flush()
+}
+
+func benchmarkFile(b *testing.B) cafs.File {
+	store := NewRamStorage(8 * 1024 * 1024)
+	temp := store.Create("benchmark")
+	defer temp.Dispose()
+	if _, err := temp.Write(randomBytes(1024 * 1024)); err != nil {
+		b.Fatal(err)
+	}
+	if err := temp.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return temp.File()
+}
+
+// Returns a run-length encoded wishlist requesting all `n` chunks transferred using the identity permutation.
+func requestAll(n int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, uint64(n)<<1|1)]
+}
+
+func BenchmarkWriteChunkData(b *testing.B) {
+	file := benchmarkFile(b)
+	defer file.Dispose()
+	wishlist := requestAll(file.NumChunks())
+
+	for _, latency := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond} {
+		for _, readAhead := range []int{0, 1, 4, 16} {
+			b.Run(fmt.Sprintf("latency=%v/readahead=%d", latency, readAhead), func(b *testing.B) {
+				sender := Sender{Encoding: RunLengthWishlist, ReadAhead: readAhead}
+				b.SetBytes(file.Size())
+				for i := 0; i < b.N; i++ {
+					chunks := slowChunks{ChunksOfFile(file), latency}
+					w := &countingFlusher{FlushWriter: NopFlushWriter{W: ioutil.Discard}}
+					err := sender.WriteChunkData(chunks, file.Size(), bytes.NewReader(wishlist), shuffle.Permutation{0}, w, nil)
+					chunks.Dispose()
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.ReportMetric(float64(w.flushes), "flushes/op")
+				}
+			})
+		}
+	}
+}
+
+func TestReadAheadCoalescesFlushes(t *testing.T) {
+	store := NewRamStorage(8 * 1024 * 1024)
+	file := addFile(t, store, randomBytes(512*1024))
+	defer file.Dispose()
+
+	for _, readAhead := range []int{0, 8} {
+		// While waiting for slow chunks, the read-ahead queue fills up
+		chunks := slowChunks{ChunksOfFile(file), time.Millisecond}
+		var buf bytes.Buffer
+		w := &countingFlusher{FlushWriter: NopFlushWriter{W: &buf}}
+		sender := Sender{Encoding: RunLengthWishlist, ReadAhead: readAhead}
+		err := sender.WriteChunkData(chunks, file.Size(), bytes.NewReader(requestAll(file.NumChunks())), shuffle.Permutation{0}, w, nil)
+		chunks.Dispose()
+		check(t, "writing chunk data", err)
+
+		// The chunk data arrives in order
+		var data bytes.Buffer
+		r := bufio.NewReader(&buf)
+		for {
+			chunk, err := readChunk(store, r, "chunk")
+			if err == io.EOF {
+				break
+			}
+			check(t, "reading chunk", err)
+			check(t, "appending chunk", appendChunk(&data, chunk))
+			chunk.Dispose()
+		}
+		assertEqual(t, file.Open(), ioutil.NopCloser(&data))
+
+		if readAhead == 0 && int64(w.flushes) != file.NumChunks() {
+			t.Errorf("Expected one flush per chunk, got %d for %d chunks", w.flushes, file.NumChunks())
+		} else if readAhead > 0 && int64(w.flushes) >= file.NumChunks() {
+			t.Errorf("Expected fewer flushes than chunks with read-ahead, got %d for %d chunks", w.flushes, file.NumChunks())
+		}
+	}
+}
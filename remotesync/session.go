@@ -0,0 +1,373 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/ratelimit"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+var ErrSessionBroken = errors.New("session broken by previous error")
+
+// Struct Session runs the remotesync protocol over a single full-duplex stream, such as a TCP
+// connection, a Unix socket, a net.Pipe or the stdin/stdout of an SSH command. Any number of
+// files can be transferred over one session, one after the other.
+//
+// One peer calls Serve, the other peer calls Fetch or FetchAll. The fetching peer starts by sending
+// a handshake, which the serving peer answers. Then, for every request of one or more files, the
+// serving peer responds with a Batch describing them. After that, the wishlist and the chunk data
+// are streamed simultaneously in opposite directions, each split into frames and terminated by an
+// empty frame. Control messages are encoded as single lines of JSON.
+type Session struct {
+	conn     io.ReadWriteCloser
+	r        *bufio.Reader
+	w        *bufio.Writer
+	log      cafs.Printer
+	limiter  ratelimit.Limiter
+	prio     ratelimit.Priority
+	observer TransferObserver
+	budget   *MemoryBudget
+	adaptive bool
+	ctx      context.Context // Done when the session is closed
+	cancel   context.CancelFunc
+
+	mutex  sync.Mutex // Guards subsequent variables and serializes calls to Fetch
+	proto  *Handshake // Protocol negotiated with peer, nil before handshake
+	broken bool       // Set when an error left the stream in an undefined state
+}
+
+// Sent by both peers at the beginning of a session.
+type sessionHello struct {
+	Handshake Handshake
+	Error     string `json:",omitempty"`
+}
+
+// Sent by the fetching peer for every batch of files.
+type sessionRequest struct {
+	Keys []cafs.SKey
+}
+
+// Sent by the serving peer in response to a sessionRequest.
+type sessionResponse struct {
+	Batch *Batch `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// Function NewSession creates a Session on top of a full-duplex stream. The session takes
+// ownership of the stream and closes it on Close.
+func NewSession(conn io.ReadWriteCloser) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+		log:    cafs.NewWriterPrinter(ioutil.Discard),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Sets the Session's log Printer.
+func (s *Session) WithPrinter(printer cafs.Printer) *Session {
+	s.log = printer
+	return s
+}
+
+// Limits the rate at which chunk data is sent (when serving) or received (when fetching).
+func (s *Session) WithLimiter(limiter ratelimit.Limiter, prio ratelimit.Priority) *Session {
+	s.limiter = limiter
+	s.prio = prio
+	return s
+}
+
+// Sets an observer to be notified about the progress of every batch served or fetched.
+func (s *Session) WithObserver(observer TransferObserver) *Session {
+	s.observer = observer
+	return s
+}
+
+// Sets a memory budget shared by all batches fetched, see Builder.WithMemoryBudget.
+func (s *Session) WithMemoryBudget(budget *MemoryBudget, adaptive bool) *Session {
+	s.budget = budget
+	s.adaptive = adaptive
+	return s
+}
+
+// Closes the underlying stream.
+func (s *Session) Close() error {
+	s.cancel()
+	return s.conn.Close()
+}
+
+// Returns the protocol negotiated with the peer, or nil if no handshake has happened yet.
+func (s *Session) Protocol() *Handshake {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.proto
+}
+
+func (s *Session) writeMessage(v interface{}) error {
+	if err := json.NewEncoder(s.w).Encode(v); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// The maximum length of a control message in bytes, including the terminating newline.
+const maxMessageSize = 64 << 20
+
+func (s *Session) readMessage(v interface{}) error {
+	var line []byte
+	for {
+		part, err := s.r.ReadSlice('\n')
+		if len(line)+len(part) > maxMessageSize {
+			return fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+		}
+		line = append(line, part...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && len(line) > 0 {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		break
+	}
+	return json.Unmarshal(line, v)
+}
+
+// Function Serve answers requests from the peer until the peer closes the stream, which results in
+// a nil error. Requested files are looked up in `storage` and transferred using permutation `perm`.
+// If `perm` is nil, a permutation is chosen for every batch based on its size and first key.
+func (s *Session) Serve(storage cafs.FileStorage, perm shuffle.Permutation) error {
+	var hello sessionHello
+	if err := s.readMessage(&hello); err != nil {
+		return fmt.Errorf("error reading handshake: %v", err)
+	}
+	proto, err := Negotiate(LocalHandshake(), hello.Handshake)
+	reply := sessionHello{Handshake: LocalHandshake()}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	if err := s.writeMessage(reply); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.proto = &proto
+	s.mutex.Unlock()
+
+	for {
+		var req sessionRequest
+		if err := s.readMessage(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading request: %v", err)
+		}
+		sender := &Sender{
+			Encoding:  proto.WishlistEncoding(),
+			Limiter:   s.limiter,
+			Priority:  s.prio,
+			Context:   s.ctx,
+			Observer:  s.observer,
+			ReadAhead: DefaultReadAhead,
+		}
+		if err := s.serveBatch(storage, req.Keys, perm, sender); err != nil {
+			return err
+		}
+	}
+}
+
+// Transfers a batch of files. Errors returned leave the stream in an undefined state.
+func (s *Session) serveBatch(storage cafs.FileStorage, keys []cafs.SKey, perm shuffle.Permutation, sender *Sender) error {
+	files := make([]cafs.File, 0, len(keys))
+	defer func() {
+		for _, f := range files {
+			f.Dispose()
+		}
+	}()
+	var size int64
+	for i := range keys {
+		file, err := storage.Get(&keys[i])
+		if err != nil {
+			s.log.Printf("Requested file %v: %v", keys[i], err)
+			return s.writeMessage(sessionResponse{Error: err.Error()})
+		}
+		files = append(files, file)
+		size += file.Size()
+	}
+
+	if perm == nil && len(keys) > 0 {
+		perm = shuffle.ForSize(size, shuffle.SeedFromKey(keys[0]))
+	}
+	batch := NewBatch(files, perm)
+	if err := s.writeMessage(sessionResponse{Batch: batch}); err != nil {
+		return err
+	}
+
+	s.log.Printf("Serving %d files (%d bytes)", len(files), size)
+	chunks := ChunksOfFiles(files)
+	defer chunks.Dispose()
+	data := newFrameWriter(s.w)
+	wishlist := bufio.NewReader(newFrameReader(s.r))
+	if err := sender.WriteChunkData(chunks, size, wishlist, batch.Perm, data, nil); err != nil {
+		return fmt.Errorf("error in WriteChunkData: %v", err)
+	}
+	return data.Close()
+}
+
+// Function Fetch requests the file identified by `key` from the serving peer and reconstructs it
+// in `storage`. Cancelling `ctx` closes the session.
+func (s *Session) Fetch(ctx context.Context, storage cafs.FileStorage, key cafs.SKey, info string) (cafs.File, error) {
+	files, err := s.FetchAll(ctx, storage, []cafs.SKey{key}, info)
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// Function FetchAll requests the files identified by `keys` from the serving peer in a single batch
+// and reconstructs them in `storage`. Chunks shared between files are transmitted only once. The
+// files are returned in the order of `keys`. Cancelling `ctx` closes the session.
+func (s *Session) FetchAll(ctx context.Context, storage cafs.FileStorage, keys []cafs.SKey, info string) (files []cafs.File, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.broken {
+		return nil, ErrSessionBroken
+	}
+
+	// Close the stream on cancellation, which unblocks all pending reads and writes.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.conn.Close()
+		case <-done:
+		}
+	}()
+
+	// Errors leave the stream in an undefined state, unless reported by the peer.
+	intact := false
+	defer func() {
+		if err != nil && !intact {
+			s.broken = true
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+		}
+	}()
+
+	if s.proto == nil {
+		if err := s.handshake(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.writeMessage(sessionRequest{Keys: keys}); err != nil {
+		return nil, err
+	}
+	var resp sessionResponse
+	if err := s.readMessage(&resp); err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if resp.Error != "" {
+		intact = true
+		if resp.Error == cafs.ErrNotFound.Error() {
+			return nil, cafs.ErrNotFound
+		}
+		return nil, fmt.Errorf("remote error: %v", resp.Error)
+	} else if resp.Batch == nil || len(resp.Batch.Files) != len(keys) {
+		return nil, errors.New("response contains no matching batch")
+	}
+
+	builder := NewBatchBuilder(storage, resp.Batch, 32, info)
+	builder.WithWishlistEncoding(s.proto.WishlistEncoding())
+	builder.WithLimiter(s.limiter, s.prio)
+	builder.WithContext(ctx)
+	builder.WithObserver(s.observer)
+	builder.WithMemoryBudget(s.budget, s.adaptive)
+	defer builder.Dispose()
+
+	// The serving peer is already waiting for the wishlist, so the session can't be continued.
+	if err := builder.Reserve(); err != nil {
+		_ = s.conn.Close()
+		return nil, err
+	}
+
+	wishlistDone := make(chan error, 1)
+	go func() {
+		w := newFrameWriter(s.w)
+		if err := builder.WriteWishList(w); err != nil {
+			wishlistDone <- fmt.Errorf("error in WriteWishList: %v", err)
+			return
+		}
+		wishlistDone <- w.Close()
+	}()
+
+	files, err = builder.ReconstructFilesFromRequestedChunks(newFrameReader(s.r))
+	if err != nil {
+		// The wishlist writer terminates once the builder is disposed.
+		_ = s.conn.Close()
+		return nil, err
+	}
+	err = <-wishlistDone
+	for i := 0; err == nil && i < len(keys); i++ {
+		if files[i].Key() != keys[i] {
+			err = fmt.Errorf("received file %v instead of %v", files[i].Key(), keys[i])
+		}
+	}
+	if err != nil {
+		for _, f := range files {
+			f.Dispose()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// Sends our handshake and negotiates a protocol from the peer's reply.
+func (s *Session) handshake() error {
+	if err := s.writeMessage(sessionHello{Handshake: LocalHandshake()}); err != nil {
+		return err
+	}
+	var reply sessionHello
+	if err := s.readMessage(&reply); err != nil {
+		return fmt.Errorf("error reading handshake: %v", err)
+	}
+	proto, err := Negotiate(LocalHandshake(), reply.Handshake)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("peer rejected handshake: %v", reply.Error)
+	}
+	s.proto = &proto
+	return nil
+}
@@ -0,0 +1,173 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+)
+
+func TestFraming(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	streams := [][]byte{nil, randomBytes(10), randomBytes(3 * maxFrameSize / 2), randomBytes(1)}
+	for _, data := range streams {
+		fw := newFrameWriter(w)
+		// Write in pieces of varying size, with intermittent flushes
+		for p := data; len(p) > 0; {
+			n := rand.Intn(len(p)) + 1
+			if _, err := fw.Write(p[:n]); err != nil {
+				t.Fatalf("Error writing: %v", err)
+			}
+			fw.Flush()
+			p = p[n:]
+		}
+		check(t, "closing frame writer", fw.Close())
+	}
+	buf.WriteString("trailer")
+
+	r := bufio.NewReader(&buf)
+	for i, data := range streams {
+		if b, err := ioutil.ReadAll(newFrameReader(r)); err != nil {
+			t.Fatalf("Error reading stream %d: %v", i, err)
+		} else if !bytes.Equal(b, data) {
+			t.Fatalf("Stream %d differs", i)
+		}
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "trailer" {
+		t.Fatalf("Unexpected trailer: %#v", string(b))
+	}
+}
+
+func addFile(t *testing.T, store cafs.FileStorage, data []byte) cafs.File {
+	temp := store.Create("test data")
+	defer temp.Dispose()
+	_, err := temp.Write(data)
+	check(t, "writing temporary", err)
+	check(t, "closing temporary", temp.Close())
+	return temp.File()
+}
+
+func TestSession(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	// File B shares most of its content with file A
+	dataA := randomBytes(512 * 1024)
+	dataB := append(append([]byte{}, dataA[:400*1024]...), randomBytes(16*1024)...)
+	fileA := addFile(t, storeA, dataA)
+	defer fileA.Dispose()
+	fileB := addFile(t, storeA, dataB)
+	defer fileB.Dispose()
+
+	connA, connB := net.Pipe()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- NewSession(connA).Serve(storeA, shuffle.Permutation(rand.Perm(20)))
+	}()
+
+	session := NewSession(connB)
+	for _, f := range []cafs.File{fileA, fileB, fileA} {
+		received, err := session.Fetch(context.Background(), storeB, f.Key(), "fetched")
+		check(t, "fetching", err)
+		assertEqual(t, f.Open(), received.Open())
+		received.Dispose()
+	}
+	if p := session.Protocol(); p == nil || p.Version != ProtocolVersion {
+		t.Errorf("Unexpected protocol: %v", p)
+	}
+
+	// Fetch a batch of files, including duplicates and a file not yet received
+	dataC := randomBytes(64 * 1024)
+	fileC := addFile(t, storeA, dataC)
+	defer fileC.Dispose()
+	keys := []cafs.SKey{fileB.Key(), fileC.Key(), fileA.Key(), fileC.Key()}
+	files, err := session.FetchAll(context.Background(), storeB, keys, "fetched batch")
+	check(t, "fetching batch", err)
+	for i, f := range files {
+		if f.Key() != keys[i] {
+			t.Errorf("File %d of batch differs", i)
+		}
+		f.Dispose()
+	}
+
+	// Requesting a missing file doesn't break the session
+	if _, err := session.Fetch(context.Background(), storeB, cafs.SKey{1, 2, 3}, "missing"); err != cafs.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	received, err := session.Fetch(context.Background(), storeB, fileB.Key(), "fetched again")
+	check(t, "fetching after error", err)
+	received.Dispose()
+
+	check(t, "closing session", session.Close())
+	check(t, "serving", <-serverErr)
+}
+
+func TestSessionIncompatiblePeer(t *testing.T) {
+	connA, connB := net.Pipe()
+	go func() {
+		// Simulate a peer using a different hash algorithm
+		peer := NewSession(connA)
+		var hello sessionHello
+		_ = peer.readMessage(&hello)
+		hello.Handshake.Hash = "blake2b"
+		_ = peer.writeMessage(hello)
+		_, _ = io.Copy(ioutil.Discard, connA)
+	}()
+
+	session := NewSession(connB)
+	defer session.Close()
+	_, err := session.Fetch(context.Background(), NewRamStorage(1024), cafs.SKey{}, "fetched")
+	if _, ok := err.(*IncompatibleError); !ok {
+		t.Fatalf("Expected *IncompatibleError, got %#v", err)
+	}
+	if _, err := session.Fetch(context.Background(), NewRamStorage(1024), cafs.SKey{}, "fetched"); err != ErrSessionBroken {
+		t.Fatalf("Expected ErrSessionBroken, got %v", err)
+	}
+}
+
+func TestSessionOversizedMessage(t *testing.T) {
+	connA, connB := net.Pipe()
+	go func() {
+		// Simulate a peer that never ends its handshake
+		data := bytes.Repeat([]byte{' '}, 64*1024)
+		for {
+			if _, err := connA.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	session := NewSession(connB)
+	defer session.Close()
+	if err := session.Serve(NewRamStorage(1024), nil); err == nil {
+		t.Fatal("Expected error reading oversized handshake")
+	} else {
+		t.Logf("Error: %v", err)
+	}
+	_ = connA.Close()
+}
+
+func TestSessionCancel(t *testing.T) {
+	connA, connB := net.Pipe()
+	defer connA.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// Peer never answers
+		_, _ = io.Copy(ioutil.Discard, connA)
+	}()
+	cancel()
+	if _, err := NewSession(connB).Fetch(ctx, NewRamStorage(1024), cafs.SKey{}, "fetched"); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
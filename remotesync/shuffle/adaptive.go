@@ -0,0 +1,69 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package shuffle
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Bounds and parameters used by SizeFor.
+const (
+	MinSize          = 1    // The smallest permutation length returned by SizeFor
+	MaxSize          = 256  // The largest permutation length returned by SizeFor
+	AverageChunkSize = 8192 // The expected average size of a chunk in bytes
+)
+
+// Function SizeFor chooses a permutation length for transmitting a file of `fileSize` bytes.
+//
+// A permutation of length k delays the first chunk by k-1 steps and makes the receiver buffer
+// up to k chunks, so short permutations are good for latency and memory. On the other hand, a
+// longer permutation makes it harder for a sender to exploit the order in which chunks are
+// requested. As a compromise, k grows with the square root of the expected number of chunks,
+// within [MinSize, MaxSize], and never exceeds the number of chunks.
+func SizeFor(fileSize int64) int {
+	chunks := fileSize / AverageChunkSize
+	if chunks < 1 {
+		chunks = 1
+	}
+	size := int(4 * math.Sqrt(float64(chunks)))
+	if int64(size) > chunks {
+		size = int(chunks)
+	}
+	if size < MinSize {
+		size = MinSize
+	} else if size > MaxSize {
+		size = MaxSize
+	}
+	return size
+}
+
+// Function SeedFromKey derives a seed from a content key, e.g. a cafs.SKey, so that all peers
+// serving the same file choose the same permutation.
+func SeedFromKey(key [32]byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]))
+}
+
+// Function ForSize returns a permutation suitable for transmitting a file of `fileSize` bytes,
+// as chosen by SizeFor. The permutation is determined by `seed`, as described by SpecForSize.
+func ForSize(fileSize int64, seed int64) Permutation {
+	perm, err := SpecForSize(fileSize, seed).Permutation()
+	if err != nil {
+		panic(err)
+	}
+	return perm
+}
@@ -0,0 +1,98 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package shuffle
+
+import (
+	"fmt"
+)
+
+// Algorithm AlgorithmSplitMix generates permutations using a Fisher-Yates shuffle driven by the
+// SplitMix64 generator. Its output is part of the protocol and must never change.
+const AlgorithmSplitMix = "splitmix64-fisher-yates"
+
+// The maximum length of a permutation generated from a Spec. Protects against absurd requests.
+const MaxSpecLength = 1 << 20
+
+// Struct Spec describes a permutation by the means to reproduce it, which is much more compact
+// than the permutation itself. Equal Specs yield equal permutations on all platforms.
+type Spec struct {
+	Algorithm string
+	Length    int
+	Seed      int64
+}
+
+// Function NewSpec returns a Spec for a permutation of length `length` generated using the default
+// algorithm.
+func NewSpec(length int, seed int64) Spec {
+	return Spec{Algorithm: AlgorithmSplitMix, Length: length, Seed: seed}
+}
+
+// Function SpecForSize returns a Spec for a permutation suitable for transmitting a file of
+// `fileSize` bytes, as chosen by SizeFor.
+func SpecForSize(fileSize int64, seed int64) Spec {
+	return NewSpec(SizeFor(fileSize), seed)
+}
+
+func (s Spec) String() string {
+	return fmt.Sprintf("%v(length=%d, seed=%d)", s.Algorithm, s.Length, s.Seed)
+}
+
+// Generates the permutation described by the Spec.
+func (s Spec) Permutation() (Permutation, error) {
+	if s.Length < 1 || s.Length > MaxSpecLength {
+		return nil, fmt.Errorf("invalid permutation length: %d", s.Length)
+	}
+	switch s.Algorithm {
+	case AlgorithmSplitMix:
+		r := splitMix64{state: uint64(s.Seed)}
+		perm := make(Permutation, s.Length)
+		for i := range perm {
+			perm[i] = i
+		}
+		for i := len(perm) - 1; i > 0; i-- {
+			j := r.intn(i + 1)
+			perm[i], perm[j] = perm[j], perm[i]
+		}
+		return perm, nil
+	}
+	return nil, fmt.Errorf("unknown permutation algorithm: %#v", s.Algorithm)
+}
+
+// Struct splitMix64 implements the SplitMix64 pseudo-random number generator. Unlike math/rand,
+// its output is fully specified.
+type splitMix64 struct {
+	state uint64
+}
+
+func (r *splitMix64) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Returns a uniformly distributed number in [0, n). Rejects values that would introduce a bias.
+func (r *splitMix64) intn(n int) int {
+	bound := uint64(n)
+	threshold := -bound % bound
+	for {
+		if v := r.next(); v >= threshold {
+			return int(v % bound)
+		}
+	}
+}
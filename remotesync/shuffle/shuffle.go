@@ -32,14 +32,14 @@ type Permutation []int
 // data element is retrieved from the buffer up to k-1 steps after
 // it is put in. A stream of data elemnts shuffled this way is
 // reversible to its original order.
+//
+// Shuffler uses nil to represent empty buffer space. New code should use ShufflerOf.
 type Shuffler struct {
-	perm   Permutation
-	buffer []interface{}
-	idx    int
+	typed *ShufflerOf[interface{}]
 }
 
 // Interface StreamShuffler is common for shufflers and unshufflers working on a
-// stream with a well-defined beginning and end.
+// stream with a well-defined beginning and end. New code should use StreamShufflerOf.
 type StreamShuffler interface {
 	// Puts one data element into the StreamShuffler. Calls the ConsumeFunc exactly once.
 	Put(interface{}) error
@@ -53,16 +53,14 @@ type StreamShuffler interface {
 // arbitrary type and returns an error.
 type ConsumeFunc func(interface{}) error
 
-// Functions of type applyFunc are used internally to apply a value returned from
-// the shuffler to a ConsumeFunc. This is necessary because shuffling and unshuffling
-// are not fully symmetric and require the substitution or removal of placeholder values.
-type applyFunc func(ConsumeFunc, interface{}) error
-
-// Type streamShuffler uses a Shuffler to permute a sequence of arbitrary length.
+// Type streamShuffler implements StreamShuffler on top of a StreamShufflerOf, translating
+// between placeholder values and empty slots.
 type streamShuffler struct {
-	consume  ConsumeFunc
-	shuffler *Shuffler
-	apply    applyFunc
+	typed StreamShufflerOf[interface{}]
+	// Converts a value put into the StreamShuffler into a slot
+	wrap func(interface{}) Slot[interface{}]
+	// Converts a ConsumeFunc into a ConsumeFuncOf
+	unwrap func(ConsumeFunc) ConsumeFuncOf[interface{}]
 }
 
 // Creates a random permutation of given length.
@@ -84,70 +82,64 @@ func (p Permutation) Inverse() Permutation {
 
 // Creates a new Shuffler based on permutation p.
 func NewShuffler(p Permutation) *Shuffler {
-	result := new(Shuffler)
-	result.perm = p
-	result.buffer = make([]interface{}, len(p))
-	return result
+	return &Shuffler{NewShufflerOf[interface{}](p)}
 }
 
 // Inputs a data element v into the shuffler and simultaneously
 // retrieves another (or, every k invocations, the same) data element.
 // May return nil while the buffer hasn't been completely filled.
 func (s *Shuffler) Put(v interface{}) interface{} {
-	i := s.idx
-	s.idx++
-	if s.idx == len(s.buffer) {
-		s.idx = 0
-	}
-	s.buffer[s.perm[i]] = v
-	return s.buffer[i]
+	return s.typed.Put(slotOf(v)).Value
 }
 
 // Returns a complimentary shuffler that reverses the permutation (except
 // for a delay of k-1 steps).
 func (s *Shuffler) Inverse() *Shuffler {
-	return NewShuffler(s.perm.Inverse())
+	return &Shuffler{s.typed.Inverse()}
 }
 
 // Returns the length k of the permutation buffer used by the shuffler.
 func (s *Shuffler) Length() int {
-	return len(s.buffer)
+	return s.typed.Length()
+}
+
+// Returns an empty slot for nil, a slot holding v otherwise.
+func slotOf(v interface{}) Slot[interface{}] {
+	if v == nil {
+		return None[interface{}]()
+	}
+	return Some(v)
 }
 
 // Creates a StreamShuffler applying a permutation to a stream. Argument `placeholder`
 // specifies a value that is inserted into the permuted stream in order to symbolize blank space.
 func NewStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler {
-	return &streamShuffler{
-		consume:  consume,
-		shuffler: NewShuffler(p),
-		apply: func(f ConsumeFunc, v interface{}) error {
-			if v == nil {
-				v = placeholder
+	unwrap := func(f ConsumeFunc) ConsumeFuncOf[interface{}] {
+		return func(s Slot[interface{}]) error {
+			if !s.Ok {
+				return f(placeholder)
 			}
-			return f(v)
-		},
+			return f(s.Value)
+		}
+	}
+	return &streamShuffler{
+		typed:  NewStreamShufflerOf(p, unwrap(consume)),
+		wrap:   slotOf,
+		unwrap: unwrap,
 	}
 }
 
 func (e *streamShuffler) Put(v interface{}) error {
-	r := e.shuffler.Put(v)
-	return e.apply(e.consume, r)
+	return e.typed.Put(e.wrap(v))
 }
 
 func (e *streamShuffler) End() error {
-	for i := 0; i < e.shuffler.Length()-1; i++ {
-		r := e.shuffler.Put(nil)
-		if err := e.apply(e.consume, r); err != nil {
-			return err
-		}
-	}
-	return nil
+	return e.typed.End()
 }
 
 func (e *streamShuffler) WithFunc(consume ConsumeFunc) StreamShuffler {
-	var s streamShuffler
-	s = *e
-	s.consume = consume
+	s := *e
+	s.typed = e.typed.WithFunc(e.unwrap(consume))
 	return &s
 }
 
@@ -156,14 +148,17 @@ func (e *streamShuffler) WithFunc(consume ConsumeFunc) StreamShuffler {
 // into the stream by the original shuffler. Values equal to `placeholder` will not
 // be forwarded to `consume`.
 func NewInverseStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler {
+	unwrap := func(f ConsumeFunc) ConsumeFuncOf[interface{}] {
+		return SkipEmpty(func(v interface{}) error { return f(v) })
+	}
 	return &streamShuffler{
-		consume:  consume,
-		shuffler: NewShuffler(p.Inverse()),
-		apply: func(f ConsumeFunc, v interface{}) error {
-			if v == nil || v == placeholder {
-				return nil
+		typed: NewInverseStreamShufflerOf(p, unwrap(consume)),
+		wrap: func(v interface{}) Slot[interface{}] {
+			if v == placeholder {
+				return None[interface{}]()
 			}
-			return f(v)
+			return slotOf(v)
 		},
+		unwrap: unwrap,
 	}
 }
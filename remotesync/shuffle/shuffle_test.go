@@ -1,6 +1,7 @@
 package shuffle
 
 import (
+	"fmt"
 	"math/rand"
 	"testing"
 )
@@ -97,6 +98,57 @@ func shuffleString(t *testing.T, in string, s StreamShuffler) (out string) {
 	return
 }
 
+func TestStreamShufflerOf(t *testing.T) {
+	rgen := rand.New(rand.NewSource(2))
+	for _, permSize := range []int{1, 2, 5, 31} {
+		perm := Random(permSize, rgen)
+		for _, str := range []string{"", "x", "0123456789abcdefghijklmnopqrstuvwxyz"} {
+			// Shuffle, representing blank space by empty slots
+			var shuffled []Slot[rune]
+			s := NewStreamShufflerOf(perm, func(v Slot[rune]) error {
+				shuffled = append(shuffled, v)
+				return nil
+			})
+			for _, c := range str {
+				check(t, s.Put(Some(c)))
+			}
+			check(t, s.End())
+
+			// The typed shuffler must produce the same stream as the legacy one
+			legacy := []rune(shuffleString(t, str, NewStreamShuffler(perm, '_', nil)))
+			if len(legacy) != len(shuffled) {
+				t.Fatalf("Length mismatch for %v: %v vs. %v", perm, len(shuffled), len(legacy))
+			}
+			for i, v := range shuffled {
+				if v.Ok && v.Value != legacy[i] || !v.Ok && legacy[i] != '_' {
+					t.Fatalf("Mismatch at %v for %v: %v vs. %q", i, perm, v, legacy[i])
+				}
+			}
+
+			// Unshuffle, skipping empty slots
+			var unshuffled []rune
+			u := NewInverseStreamShufflerOf(perm, SkipEmpty(func(c rune) error {
+				unshuffled = append(unshuffled, c)
+				return nil
+			}))
+			for _, v := range shuffled {
+				check(t, u.Put(v))
+			}
+			check(t, u.End())
+			if string(unshuffled) != str {
+				t.Fatalf("Unshuffling with %v returned %#v. Expected: %#v", perm, string(unshuffled), str)
+			}
+		}
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Test that doing multiple simultaneous transmissions via a buffered connection to a simultated
 // caching receiver actually reduces the amount of data per transmission to the expected degree.
 func TestTransmission(t *testing.T) {
@@ -160,3 +212,72 @@ func TestTransmission(t *testing.T) {
 	t.Logf("Expected:           % 5.2f", 1+float64(NTRANSMISSIONS-1)*float64(BUFFER_SIZE)/float64(PERMUTATION_SIZE))
 	// TODO: Add actual test here
 }
+
+func TestSizeFor(t *testing.T) {
+	prev := 0
+	for _, fileSize := range []int64{0, 1, AverageChunkSize, 10 * AverageChunkSize, 1 << 20, 1 << 30, 1 << 40} {
+		size := SizeFor(fileSize)
+		if size < MinSize || size > MaxSize || size < prev {
+			t.Errorf("Unexpected size %d for file size %d (previous: %d)", size, fileSize, prev)
+		}
+		if chunks := fileSize / AverageChunkSize; chunks > 0 && int64(size) > chunks {
+			t.Errorf("Size %d exceeds number of chunks %d", size, chunks)
+		}
+		prev = size
+	}
+	if SizeFor(1<<40) != MaxSize {
+		t.Errorf("Expected large files to use the maximum size")
+	}
+}
+
+func TestForSize(t *testing.T) {
+	var key [32]byte
+	key[0], key[7] = 1, 2
+	a := ForSize(1<<20, SeedFromKey(key))
+	b := ForSize(1<<20, SeedFromKey(key))
+	if len(a) != SizeFor(1<<20) {
+		t.Fatalf("Unexpected length %d", len(a))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Permutations differ for the same seed: %v vs %v", a, b)
+		}
+	}
+	key[0] = 3
+	if fmt.Sprint(ForSize(1<<20, SeedFromKey(key))) == fmt.Sprint(a) {
+		t.Errorf("Expected different permutations for different seeds")
+	}
+}
+
+func TestSpec(t *testing.T) {
+	// The generated permutations are part of the protocol and must never change
+	r := splitMix64{}
+	if v := r.next(); v != 0xe220a8397b1dcdaf {
+		t.Errorf("SplitMix64 deviates from reference: %x", v)
+	}
+	if p, err := NewSpec(10, 42).Permutation(); err != nil {
+		t.Fatal(err)
+	} else if s := fmt.Sprint(p); s != "[0 9 5 8 6 4 7 2 1 3]" {
+		t.Errorf("Unexpected permutation: %v", s)
+	}
+
+	for _, length := range []int{1, 2, 10, 256, 1000} {
+		p, err := NewSpec(length, int64(length)).Permutation()
+		if err != nil {
+			t.Fatalf("Error generating permutation of length %d: %v", length, err)
+		}
+		seen := make([]bool, length)
+		for _, v := range p {
+			if v < 0 || v >= length || seen[v] {
+				t.Fatalf("Not a permutation: %v", p)
+			}
+			seen[v] = true
+		}
+	}
+
+	for _, spec := range []Spec{NewSpec(0, 1), NewSpec(MaxSpecLength+1, 1), {Algorithm: "unknown", Length: 10}} {
+		if _, err := spec.Permutation(); err == nil {
+			t.Errorf("Expected error for %v", spec)
+		}
+	}
+}
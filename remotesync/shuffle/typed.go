@@ -0,0 +1,141 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package shuffle
+
+// Type Slot holds either a data element of type T or nothing. Shufflers emit empty slots
+// while their buffer is filling up and while it is being drained at the end of a stream.
+type Slot[T any] struct {
+	Value T
+	Ok    bool // false if the slot is empty
+}
+
+// Function Some returns a slot holding `v`.
+func Some[T any](v T) Slot[T] {
+	return Slot[T]{Value: v, Ok: true}
+}
+
+// Function None returns an empty slot.
+func None[T any]() Slot[T] {
+	return Slot[T]{}
+}
+
+// Type ShufflerOf is the type-safe counterpart of Shuffler.
+type ShufflerOf[T any] struct {
+	perm   Permutation
+	buffer []Slot[T]
+	idx    int
+}
+
+// Creates a new ShufflerOf based on permutation p.
+func NewShufflerOf[T any](p Permutation) *ShufflerOf[T] {
+	return &ShufflerOf[T]{
+		perm:   p,
+		buffer: make([]Slot[T], len(p)),
+	}
+}
+
+// Inputs a slot into the shuffler and simultaneously retrieves another (or, every k
+// invocations, the same) slot. Returns empty slots while the buffer hasn't been completely filled.
+func (s *ShufflerOf[T]) Put(v Slot[T]) Slot[T] {
+	i := s.idx
+	s.idx++
+	if s.idx == len(s.buffer) {
+		s.idx = 0
+	}
+	s.buffer[s.perm[i]] = v
+	r := s.buffer[i]
+	// The slot is always written again before being read next, so don't keep the reference.
+	s.buffer[i] = Slot[T]{}
+	return r
+}
+
+// Returns a complimentary shuffler that reverses the permutation (except
+// for a delay of k-1 steps).
+func (s *ShufflerOf[T]) Inverse() *ShufflerOf[T] {
+	return NewShufflerOf[T](s.perm.Inverse())
+}
+
+// Returns the length k of the permutation buffer used by the shuffler.
+func (s *ShufflerOf[T]) Length() int {
+	return len(s.buffer)
+}
+
+// Type ConsumeFuncOf receives the slots leaving a StreamShufflerOf.
+type ConsumeFuncOf[T any] func(Slot[T]) error
+
+// Function SkipEmpty returns a ConsumeFuncOf that passes the values of non-empty slots to `f`
+// and ignores empty slots. Typically used with inverse stream shufflers.
+func SkipEmpty[T any](f func(T) error) ConsumeFuncOf[T] {
+	return func(s Slot[T]) error {
+		if !s.Ok {
+			return nil
+		}
+		return f(s.Value)
+	}
+}
+
+// Interface StreamShufflerOf is the type-safe counterpart of StreamShuffler. Empty slots are
+// represented explicitly instead of by placeholder values.
+type StreamShufflerOf[T any] interface {
+	// Puts one slot into the StreamShufflerOf. Calls the ConsumeFuncOf exactly once.
+	Put(Slot[T]) error
+	// Feeds remaining slots from the buffer into the ConsumeFuncOf, calling it k-1 times.
+	End() error
+	// Returns a shallow copy of this StreamShufflerOf with a different ConsumeFuncOf.
+	WithFunc(consume ConsumeFuncOf[T]) StreamShufflerOf[T]
+}
+
+// Type streamShufflerOf uses a ShufflerOf to permute a sequence of arbitrary length.
+type streamShufflerOf[T any] struct {
+	consume  ConsumeFuncOf[T]
+	shuffler *ShufflerOf[T]
+}
+
+// Creates a StreamShufflerOf applying a permutation to a stream. The ConsumeFuncOf receives
+// empty slots wherever the permuted stream contains blank space.
+func NewStreamShufflerOf[T any](p Permutation, consume ConsumeFuncOf[T]) StreamShufflerOf[T] {
+	return &streamShufflerOf[T]{
+		consume:  consume,
+		shuffler: NewShufflerOf[T](p),
+	}
+}
+
+// Creates a StreamShufflerOf applying the inverse permutation and thereby restoring the
+// original stream order. Empty slots put into the original shuffler must be put into the
+// inverse shuffler as well. Use SkipEmpty to consume only the restored elements.
+func NewInverseStreamShufflerOf[T any](p Permutation, consume ConsumeFuncOf[T]) StreamShufflerOf[T] {
+	return NewStreamShufflerOf[T](p.Inverse(), consume)
+}
+
+func (e *streamShufflerOf[T]) Put(v Slot[T]) error {
+	return e.consume(e.shuffler.Put(v))
+}
+
+func (e *streamShufflerOf[T]) End() error {
+	for i := 0; i < e.shuffler.Length()-1; i++ {
+		if err := e.consume(e.shuffler.Put(None[T]())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *streamShufflerOf[T]) WithFunc(consume ConsumeFuncOf[T]) StreamShufflerOf[T] {
+	s := *e
+	s.consume = consume
+	return &s
+}
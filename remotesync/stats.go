@@ -0,0 +1,194 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Struct TransferStats describes the progress of a transmission, as seen by either the sender or
+// the receiver. Chunk counts don't include the placeholders inserted by the shuffler.
+type TransferStats struct {
+	ChunksTotal       int // Chunks in the file(s). The sender learns about chunks as it goes.
+	ChunksRequested   int // Chunks requested by the receiver so far
+	ChunksReused      int // Chunks not requested because already present or requested earlier
+	ChunksTransferred int // Requested chunks whose data has been sent or received
+
+	BytesTotal       int64 // Size of the file(s)
+	BytesRequested   int64 // Size of the chunks requested so far
+	BytesReused      int64 // Size of the chunks not requested
+	BytesTransferred int64 // Size of the chunk data sent or received, excluding framing
+
+	Started      time.Time // When the transmission started
+	WishlistDone time.Time // When the complete wishlist was written (receiver) or read (sender)
+	Finished     time.Time // When the transmission ended, successfully or not
+}
+
+// Returns true if the transmission has ended.
+func (s TransferStats) Done() bool {
+	return !s.Finished.IsZero()
+}
+
+// Returns the time passed since the transmission started, or its total duration if done.
+func (s TransferStats) Elapsed() time.Duration {
+	if s.Started.IsZero() {
+		return 0
+	} else if s.Done() {
+		return s.Finished.Sub(s.Started)
+	}
+	return time.Since(s.Started)
+}
+
+// Returns the time it took to transmit the wishlist, or the time passed so far.
+func (s TransferStats) WishlistDuration() time.Duration {
+	if s.WishlistDone.IsZero() {
+		return s.Elapsed()
+	}
+	return s.WishlistDone.Sub(s.Started)
+}
+
+// Returns the time between the wishlist being completed and the end of the transmission, i.e. the
+// time spent waiting for the remaining chunk data, or the time passed so far.
+func (s TransferStats) TailDuration() time.Duration {
+	if s.WishlistDone.IsZero() {
+		return 0
+	} else if s.Done() {
+		return s.Finished.Sub(s.WishlistDone)
+	}
+	return time.Since(s.WishlistDone)
+}
+
+// Returns the average rate of chunk data transferred, in bytes per second.
+func (s TransferStats) Throughput() float64 {
+	elapsed := s.Elapsed().Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.BytesTransferred) / elapsed
+}
+
+// Returns the number of bytes that might still need to be transferred. Before the wishlist is
+// complete, this is an upper bound that assumes all undecided chunks will be requested.
+func (s TransferStats) BytesRemaining() int64 {
+	if s.WishlistDone.IsZero() {
+		return s.BytesTotal - s.BytesReused - s.BytesTransferred
+	}
+	return s.BytesRequested - s.BytesTransferred
+}
+
+// Estimates the time until the transmission ends, based on the throughput so far. Returns false
+// if there is not enough information for an estimate.
+func (s TransferStats) ETA() (time.Duration, bool) {
+	if s.Done() {
+		return 0, true
+	}
+	throughput := s.Throughput()
+	if throughput <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(s.BytesRemaining()) / throughput * float64(time.Second)), true
+}
+
+func (s TransferStats) String() string {
+	return fmt.Sprintf("%d/%d chunks (%d/%d bytes) transferred, %d chunks (%d bytes) reused, took %v (wishlist: %v) at %.2f KB/s",
+		s.ChunksTransferred, s.ChunksRequested, s.BytesTransferred, s.BytesRequested,
+		s.ChunksReused, s.BytesReused, s.Elapsed(), s.WishlistDuration(), s.Throughput()/1024)
+}
+
+// Interface TransferObserver is notified about the progress of a transmission. It is called
+// whenever a chunk has been decided upon or transferred, and once with Done() being true at the end.
+type TransferObserver interface {
+	TransferProgress(stats TransferStats)
+}
+
+// Type TransferObserverFunc adapts a function to the TransferObserver interface.
+type TransferObserverFunc func(stats TransferStats)
+
+func (f TransferObserverFunc) TransferProgress(stats TransferStats) {
+	f(stats)
+}
+
+// Function chainObservers returns an observer notifying all non-nil observers given, or nil.
+func chainObservers(observers ...TransferObserver) TransferObserver {
+	var result []TransferObserver
+	for _, o := range observers {
+		if o != nil {
+			result = append(result, o)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	} else if len(result) == 1 {
+		return result[0]
+	}
+	return TransferObserverFunc(func(stats TransferStats) {
+		for _, o := range result {
+			o.TransferProgress(stats)
+		}
+	})
+}
+
+// Struct transferTracker accumulates TransferStats from possibly several goroutines and reports
+// them to an optional observer. Observer calls are serialized.
+type transferTracker struct {
+	mutex    sync.Mutex
+	stats    TransferStats
+	observer TransferObserver
+	notify   sync.Mutex // Serializes calls to observer
+}
+
+// Applies `f` to the stats and notifies the observer.
+func (t *transferTracker) update(f func(s *TransferStats)) {
+	// Holding t.notify makes sure the observer sees the updates in order.
+	t.notify.Lock()
+	defer t.notify.Unlock()
+
+	t.mutex.Lock()
+	f(&t.stats)
+	stats := t.stats
+	t.mutex.Unlock()
+
+	if t.observer != nil {
+		t.observer.TransferProgress(stats)
+	}
+}
+
+// Returns a snapshot of the current stats.
+func (t *transferTracker) snapshot() TransferStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stats
+}
+
+// Accounts for a chunk and whether it was requested.
+func (s *TransferStats) addChunk(size int64, requested bool) {
+	if requested {
+		s.ChunksRequested++
+		s.BytesRequested += size
+	} else {
+		s.ChunksReused++
+		s.BytesReused += size
+	}
+}
+
+// Accounts for the data of a requested chunk being transferred.
+func (s *TransferStats) addTransferred(size int64) {
+	s.ChunksTransferred++
+	s.BytesTransferred += size
+}
@@ -18,6 +18,7 @@ package remotesync
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking"
@@ -28,22 +29,113 @@ import (
 // Struct SyncInfo contains information which two CAFS instances have to agree on before
 // transmitting a file.
 type SyncInfo struct {
-	Chunks []ChunkInfo         // hashes and sizes of chunks
-	Perm   shuffle.Permutation // the permutation of chunks to use when transferring
+	Chunks   []ChunkInfo         // hashes and sizes of chunks
+	Perm     shuffle.Permutation `json:",omitempty"` // the permutation of chunks to use when transferring
+	PermSpec *shuffle.Spec       `json:",omitempty"` // if not nil, describes Perm
+	Key      *cafs.SKey          `json:",omitempty"` // if not nil, the key of the complete file
+	Size     int64               `json:",omitempty"` // the size of the complete file, valid if Key is not nil
+}
+
+// Struct FileMismatchError is returned when a reconstructed file doesn't match the key and size
+// advertised in the SyncInfo.
+type FileMismatchError struct {
+	ExpectedKey, Key   cafs.SKey
+	ExpectedSize, Size int64
+}
+
+func (e *FileMismatchError) Error() string {
+	return fmt.Sprintf("reconstructed file %v (%d bytes) doesn't match expected file %v (%d bytes)",
+		e.Key, e.Size, e.ExpectedKey, e.ExpectedSize)
+}
+
+// Feature FeatureSeededPermutation signals that the peer understands SyncInfos describing their
+// permutation by a shuffle.Spec only.
+const FeatureSeededPermutation Feature = "perm-spec"
+
+func init() {
+	supportedFeatures = append(supportedFeatures, FeatureSeededPermutation)
 }
 
 // Func SetNoPermutation sets the prmutation to the trivial permutation (the one that doesn't permute).
 func (s *SyncInfo) SetTrivialPermutation() {
 	s.Perm = []int{0}
+	s.PermSpec = nil
 }
 
 // Func SetPermutation sets the permutation to use when transferring chunks.
 func (s *SyncInfo) SetPermutation(perm shuffle.Permutation) {
 	s.Perm = append(s.Perm[:0], perm...)
+	s.PermSpec = nil
+}
+
+// Func SetPermutationSpec sets the permutation to use when transferring chunks to the one
+// generated from `spec`.
+func (s *SyncInfo) SetPermutationSpec(spec shuffle.Spec) error {
+	perm, err := spec.Permutation()
+	if err != nil {
+		return err
+	}
+	s.Perm = perm
+	s.PermSpec = &spec
+	return nil
+}
+
+// Returns a copy of the SyncInfo that omits the permutation if it can be generated from PermSpec.
+// Use only if the peer supports FeatureSeededPermutation.
+func (s *SyncInfo) Compact() *SyncInfo {
+	result := *s
+	if s.PermSpec != nil {
+		result.Perm = nil
+	}
+	return &result
+}
+
+// Checks that `key` and `size` match the file described by the SyncInfo. Returns a *FileMismatchError
+// if they don't. Always succeeds if the SyncInfo doesn't carry a file key, e.g. when received from a
+// legacy peer.
+func (s *SyncInfo) Verify(key cafs.SKey, size int64) error {
+	if s.Key == nil || (key == *s.Key && size == s.Size) {
+		return nil
+	}
+	return &FileMismatchError{ExpectedKey: *s.Key, Key: key, ExpectedSize: s.Size, Size: size}
 }
 
-// Func SetChunksFromFile prepares sync information for a CAFS file.
+// Decodes a SyncInfo from JSON. If the permutation is given as a PermSpec only, it is generated.
+// If the file key is given, the file size must match the sizes of the chunks.
+func (s *SyncInfo) UnmarshalJSON(data []byte) error {
+	type plain SyncInfo // prevents recursion
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	if p.PermSpec != nil {
+		perm, err := p.PermSpec.Permutation()
+		if err != nil {
+			return err
+		}
+		if len(p.Perm) > 0 && !equalPermutations(p.Perm, perm) {
+			return fmt.Errorf("permutation doesn't match %v", p.PermSpec)
+		}
+		p.Perm = perm
+	}
+	if p.Key != nil {
+		var total int64
+		for _, ci := range p.Chunks {
+			total += int64(ci.Size)
+		}
+		if total != p.Size {
+			return fmt.Errorf("file size %d doesn't match total size of chunks %d", p.Size, total)
+		}
+	}
+	*s = SyncInfo(p)
+	return nil
+}
+
+// Func SetChunksFromFile prepares sync information for a CAFS file, including its key and size.
 func (s *SyncInfo) SetChunksFromFile(file cafs.File) {
+	key := file.Key()
+	s.Key = &key
+	s.Size = file.Size()
 	if !file.IsChunked() {
 		s.Chunks = append(s.Chunks[:0], ChunkInfo{
 			Key:  file.Key(),
@@ -99,6 +191,18 @@ func (s *SyncInfo) WriteToLegacyStream(stream io.Writer) error {
 	return nil
 }
 
+func equalPermutations(a, b shuffle.Permutation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *SyncInfo) addChunk(key cafs.SKey, size int64) {
 	s.Chunks = append(s.Chunks, ChunkInfo{key, intsize(size)})
 }
@@ -118,14 +222,12 @@ func intsize(size int64) int {
 // a certain chunk while others are already available.
 func (s *SyncInfo) Shuffle() *SyncInfo {
 	newChunks := make([]ChunkInfo, 0, len(s.Chunks))
-	shuffler := shuffle.NewStreamShuffler(s.Perm, nil, func(v interface{}) error {
-		if v != nil {
-			newChunks = append(newChunks, v.(ChunkInfo))
-		}
+	shuffler := shuffle.NewStreamShufflerOf(s.Perm, shuffle.SkipEmpty(func(c ChunkInfo) error {
+		newChunks = append(newChunks, c)
 		return nil
-	})
+	}))
 	for _, c := range s.Chunks {
-		_ = shuffler.Put(c)
+		_ = shuffler.Put(shuffle.Some(c))
 	}
 	_ = shuffler.End()
 	return &SyncInfo{
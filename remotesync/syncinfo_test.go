@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"strings"
 	"testing"
 )
 
@@ -32,3 +35,55 @@ func TestSyncInfoJSON(t *testing.T) {
 		t.Fatalf("Encoding differs")
 	}
 }
+
+func TestSyncInfoCompactJSON(t *testing.T) {
+	file := addFile(t, NewRamStorage(1<<20), randomBytes(256*1024))
+	defer file.Dispose()
+
+	var info SyncInfo
+	info.SetChunksFromFile(file)
+	check(t, "setting permutation spec", info.SetPermutationSpec(shuffle.NewSpec(100, 7)))
+
+	// The compact form carries only the seed, the full form carries both
+	compact, err := json.Marshal(info.Compact())
+	check(t, "encoding compact SyncInfo", err)
+	full, err := json.Marshal(&info)
+	check(t, "encoding full SyncInfo", err)
+	if strings.Contains(string(compact), `"Perm"`) || len(compact) >= len(full) {
+		t.Errorf("Expected compact form to omit permutation: %v", string(compact))
+	}
+
+	for _, data := range [][]byte{compact, full} {
+		var decoded SyncInfo
+		check(t, "decoding SyncInfo", json.Unmarshal(data, &decoded))
+		if !equalPermutations(decoded.Perm, info.Perm) || len(decoded.Chunks) != len(info.Chunks) {
+			t.Errorf("Decoded SyncInfo differs")
+		}
+		if decoded.Key == nil || *decoded.Key != file.Key() || decoded.Size != file.Size() {
+			t.Errorf("Decoded SyncInfo doesn't describe file: %v, %d bytes", decoded.Key, decoded.Size)
+		}
+	}
+
+	// The file size must match the chunks
+	var decoded SyncInfo
+	info.Size++
+	data, err := json.Marshal(&info)
+	check(t, "encoding SyncInfo", err)
+	if err := json.Unmarshal(data, &decoded); err == nil {
+		t.Errorf("Expected error for mismatching file size")
+	}
+
+	// Explicit permutations are still accepted, but must match a given spec
+	decoded = SyncInfo{}
+	check(t, "decoding explicit permutation", json.Unmarshal([]byte(`{"Chunks":[],"Perm":[1,0]}`), &decoded))
+	if !equalPermutations(decoded.Perm, shuffle.Permutation{1, 0}) || decoded.PermSpec != nil {
+		t.Errorf("Unexpected permutation: %v", decoded.Perm)
+	}
+	mismatch := `{"Perm":[1,0],"PermSpec":{"Algorithm":"splitmix64-fisher-yates","Length":2,"Seed":1}}`
+	if p, _ := shuffle.NewSpec(2, 1).Permutation(); p[0] == 1 {
+		mismatch = strings.Replace(mismatch, "[1,0]", "[0,1]", 1)
+	}
+	if err := json.Unmarshal([]byte(mismatch), &decoded); err == nil {
+		t.Errorf("Expected error for mismatching permutation")
+	}
+}
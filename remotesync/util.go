@@ -19,6 +19,7 @@ package remotesync
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking"
@@ -58,6 +59,16 @@ func (f NopFlushWriter) Write(p []byte) (n int, err error) {
 func (f NopFlushWriter) Flush() {
 }
 
+// Struct limitedFlushWriter replaces the Write method of a FlushWriter by that of another writer.
+type limitedFlushWriter struct {
+	FlushWriter
+	w io.Writer
+}
+
+func (l limitedFlushWriter) Write(p []byte) (n int, err error) {
+	return l.w.Write(p)
+}
+
 // The key pertaining to the SHA256 of an empty string is used to represent placeholders
 // for empty slots generated by shuffled transmissions.
 var emptyKey = *cafs.MustParseKey("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
@@ -86,6 +97,7 @@ func writeVarint(w io.Writer, value int64) error {
 	return err
 }
 
+// Struct bitWriter implements the BitWishlist encoding.
 type bitWriter struct {
 	w   FlushWriter
 	n   int
@@ -105,21 +117,29 @@ func (w *bitWriter) WriteBit(b bool) (err error) {
 	w.n++
 	if w.n == 8 {
 		_, err = w.w.Write(w.buf[:])
-		if err == nil {
-			w.w.Flush()
-		}
 		w.n = 0
 	}
 	return
 }
 
-func (w *bitWriter) Flush() (err error) {
+// Flushes all completed bytes. Up to seven bits may remain pending.
+func (w *bitWriter) Flush() error {
+	w.w.Flush()
+	return nil
+}
+
+// Pads the last byte with zero bits and flushes.
+func (w *bitWriter) Close() (err error) {
 	for err == nil && w.n != 0 {
 		err = w.WriteBit(false)
 	}
+	if err == nil {
+		w.w.Flush()
+	}
 	return
 }
 
+// Struct bitReader reads the BitWishlist encoding.
 type bitReader struct {
 	r io.ByteReader
 	n uint
@@ -146,6 +166,14 @@ func (r *bitReader) ReadBit() (bit bool, err error) {
 	return
 }
 
+// Expects the stream to end after the last byte read.
+func (r *bitReader) End() error {
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("wishlist too long")
+	}
+	return nil
+}
+
 // Function readChunk reads a single chunk worth of data from stream `r` into a new
 // file on FileStorage `s`.
 // The expected encoding is (varint, data...).
@@ -0,0 +1,169 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Feature FeatureRunLengthWishlist signals support for the RunLengthWishlist encoding.
+const FeatureRunLengthWishlist Feature = "wishlist-rle"
+
+func init() {
+	supportedFeatures = append(supportedFeatures, FeatureRunLengthWishlist)
+}
+
+// Type WishlistEncoding specifies how the receiver encodes the wishlist, i.e. the sequence of
+// bits telling the sender which chunks to transmit.
+type WishlistEncoding int
+
+const (
+	// One bit per chunk, most significant bit first, with the last byte padded with zeros.
+	// Understood by all peers.
+	BitWishlist WishlistEncoding = iota
+	// A sequence of runs of equal bits, each encoded as uvarint (length << 1 | bit). Adjacent runs
+	// may carry the same bit. Requires FeatureRunLengthWishlist.
+	RunLengthWishlist
+)
+
+func (e WishlistEncoding) String() string {
+	switch e {
+	case BitWishlist:
+		return "bits"
+	case RunLengthWishlist:
+		return "run-length"
+	}
+	return fmt.Sprintf("WishlistEncoding(%d)", int(e))
+}
+
+// Returns the wishlist encoding to use with a negotiated protocol.
+func (h Handshake) WishlistEncoding() WishlistEncoding {
+	if h.Supports(FeatureRunLengthWishlist) {
+		return RunLengthWishlist
+	}
+	return BitWishlist
+}
+
+// Interface wishlistWriter is implemented by the writing side of all wishlist encodings.
+type wishlistWriter interface {
+	WriteBit(b bool) error
+	// Makes the bits written so far available to the sender, as far as the encoding permits.
+	Flush() error
+	// Writes all pending bits and flushes. Must be called after the last bit.
+	Close() error
+}
+
+// Interface wishlistReader is implemented by the reading side of all wishlist encodings.
+type wishlistReader interface {
+	ReadBit() (bool, error)
+	// Checks that the wishlist ends after the last bit read.
+	End() error
+}
+
+func newWishlistWriter(e WishlistEncoding, w FlushWriter) wishlistWriter {
+	if e == RunLengthWishlist {
+		return &runLengthWriter{w: w}
+	}
+	return newBitWriter(w)
+}
+
+func newWishlistReader(e WishlistEncoding, r io.ByteReader) wishlistReader {
+	if e == RunLengthWishlist {
+		return &runLengthReader{r: r}
+	}
+	return newBitReader(r)
+}
+
+// Struct runLengthWriter implements the RunLengthWishlist encoding.
+type runLengthWriter struct {
+	w   FlushWriter
+	bit bool   // value of the current run
+	n   uint64 // length of the current run
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *runLengthWriter) WriteBit(b bool) error {
+	if w.n > 0 && b != w.bit {
+		if err := w.writeRun(); err != nil {
+			return err
+		}
+	}
+	w.bit = b
+	w.n++
+	return nil
+}
+
+func (w *runLengthWriter) writeRun() error {
+	if w.n == 0 {
+		return nil
+	}
+	v := w.n << 1
+	if w.bit {
+		v |= 1
+	}
+	w.n = 0
+	_, err := w.w.Write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+	return err
+}
+
+func (w *runLengthWriter) Flush() error {
+	if err := w.writeRun(); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return nil
+}
+
+func (w *runLengthWriter) Close() error {
+	return w.Flush()
+}
+
+// Struct runLengthReader reads the RunLengthWishlist encoding.
+type runLengthReader struct {
+	r   io.ByteReader
+	bit bool   // value of the current run
+	n   uint64 // bits remaining in the current run
+}
+
+func (r *runLengthReader) ReadBit() (bool, error) {
+	if r.n == 0 {
+		v, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return false, err
+		}
+		if v>>1 == 0 {
+			return false, errors.New("wishlist contains empty run")
+		}
+		r.bit = v&1 != 0
+		r.n = v >> 1
+	}
+	r.n--
+	return r.bit, nil
+}
+
+func (r *runLengthReader) End() error {
+	if r.n != 0 {
+		return errors.New("wishlist too long")
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return errors.New("wishlist too long")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Struct countingFlushWriter counts calls to Flush.
+type countingFlushWriter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (w *countingFlushWriter) Flush() {
+	w.flushes++
+}
+
+func TestWishlistEncodings(t *testing.T) {
+	patterns := map[string]func(i int) bool{
+		"none":   func(i int) bool { return false },
+		"all":    func(i int) bool { return true },
+		"random": func(i int) bool { return rand.Intn(2) == 0 },
+		"sparse": func(i int) bool { return rand.Intn(100) == 0 },
+	}
+	for name, pattern := range patterns {
+		for _, n := range []int{0, 1, 7, 8, 9, 1000, 1000000} {
+			bits := make([]bool, n)
+			for i := range bits {
+				bits[i] = pattern(i)
+			}
+			for _, enc := range []WishlistEncoding{BitWishlist, RunLengthWishlist} {
+				var buf countingFlushWriter
+				w := newWishlistWriter(enc, &buf)
+				for _, b := range bits {
+					check(t, "writing bit", w.WriteBit(b))
+				}
+				check(t, "closing wishlist", w.Close())
+				size := buf.Len()
+
+				r := newWishlistReader(enc, bufio.NewReader(&buf))
+				for i, b := range bits {
+					if v, err := r.ReadBit(); err != nil {
+						t.Fatalf("%v/%v/%d: error reading bit %d: %v", name, enc, n, i, err)
+					} else if v != b {
+						t.Fatalf("%v/%v/%d: bit %d differs", name, enc, n, i)
+					}
+				}
+				// The bit encoding pads to full bytes with zeros
+				if enc == BitWishlist {
+					for i := n; i%8 != 0; i++ {
+						if v, err := r.ReadBit(); err != nil || v {
+							t.Fatalf("%v/%v/%d: invalid padding", name, enc, n)
+						}
+					}
+				}
+				check(t, "ending wishlist", r.End())
+
+				if n == 1000000 && (name == "none" || name == "all") {
+					t.Logf("%v/%v/%d: %d bytes", name, enc, n, size)
+					if enc == RunLengthWishlist && size > 8 {
+						t.Errorf("Run-length wishlist too large: %d bytes", size)
+					}
+				}
+				if buf.flushes != 1 {
+					t.Errorf("Expected exactly one flush, got %d", buf.flushes)
+				}
+			}
+		}
+	}
+}
+
+func TestRunLengthWishlistTooLong(t *testing.T) {
+	var buf countingFlushWriter
+	w := newWishlistWriter(RunLengthWishlist, &buf)
+	for i := 0; i < 10; i++ {
+		check(t, "writing bit", w.WriteBit(true))
+	}
+	check(t, "closing wishlist", w.Close())
+	r := newWishlistReader(RunLengthWishlist, bufio.NewReader(&buf))
+	for i := 0; i < 9; i++ {
+		_, _ = r.ReadBit()
+	}
+	if err := r.End(); err == nil {
+		t.Errorf("Expected error when ending wishlist prematurely")
+	}
+}